@@ -6,7 +6,11 @@ require (
 	github.com/beefsack/go-rate v0.0.0-20180408011153-efa7637bb9b6
 	github.com/cloudflare/cloudflare-go v0.10.9
 	github.com/jinzhu/configor v1.1.1
-	github.com/sirupsen/logrus v1.4.2
+	github.com/prometheus/client_golang v1.11.1
+	github.com/sirupsen/logrus v1.6.0
 	github.com/tidwall/gjson v1.14.0
+	github.com/tidwall/sjson v1.2.4
+	golang.org/x/net v0.0.0-20200625001655-4c5254603344
 	gopkg.in/confluentinc/confluent-kafka-go.v1 v1.1.0
+	gopkg.in/yaml.v2 v2.3.0
 )
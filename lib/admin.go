@@ -0,0 +1,92 @@
+package lib
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrRuleNotFound is returned when no subscription has the rule name
+var ErrRuleNotFound = errors.New("rule not found")
+
+// RuleStatus is the runtime status of a rule
+type RuleStatus struct {
+	Name          string            `json:"name"`
+	TaskType      string            `json:"taskType"`
+	Topics        []string          `json:"topics"`
+	Subscribed    bool              `json:"subscribed"`
+	Paused        bool              `json:"paused"`
+	Partitions    []PartitionStatus `json:"partitions"`
+	LastError     string            `json:"lastError,omitempty"`
+	LastErrorTime *time.Time        `json:"lastErrorTime,omitempty"`
+}
+
+// PartitionStatus is the consuming status of a partition assigned to a rule
+type PartitionStatus struct {
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+	Committed int64  `json:"committed"`
+	High      int64  `json:"high"`
+	Lag       int64  `json:"lag"`
+}
+
+// OffsetReset describes the new offsets of a rule
+type OffsetReset struct {
+	// To is one of "earliest", "latest", "time" and "offset"
+	To     string
+	Time   time.Time
+	Offset int64
+	// Topic and Partition limit the reset to some partitions, Partition is -1 for all partitions
+	Topic     string
+	Partition int32
+}
+
+// Status returns the runtime status of all rules
+func (s *Subscriber) Status() []RuleStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	statuses := make([]RuleStatus, 0, len(s.subscriptions))
+	for _, sub := range s.subscriptions {
+		statuses = append(statuses, sub.Status())
+	}
+	return statuses
+}
+
+// Pause stops consuming messages of a rule, without leaving the consumer group
+func (s *Subscriber) Pause(name string) error {
+	sub, err := s.find(name)
+	if err != nil {
+		return err
+	}
+	return sub.Pause()
+}
+
+// Resume continues consuming messages of a paused rule
+func (s *Subscriber) Resume(name string) error {
+	sub, err := s.find(name)
+	if err != nil {
+		return err
+	}
+	return sub.Resume()
+}
+
+// ResetOffsets commits new offsets for the partitions assigned to a rule and consumes from there
+func (s *Subscriber) ResetOffsets(name string, reset OffsetReset) error {
+	sub, err := s.find(name)
+	if err != nil {
+		return err
+	}
+	return sub.ResetOffsets(reset)
+}
+
+func (s *Subscriber) find(name string) (Subscription, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i, rule := range s.rules {
+		if rule.Name == name {
+			return s.subscriptions[i], nil
+		}
+	}
+	return nil, ErrRuleNotFound
+}
@@ -1,25 +1,50 @@
 package lib
 
 import (
+	"errors"
+	"fmt"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	rate "github.com/beefsack/go-rate"
+	"github.com/mudkipme/timburr/lib/filter"
 	"github.com/mudkipme/timburr/lib/task"
+	"github.com/mudkipme/timburr/metrics"
 	"github.com/mudkipme/timburr/utils"
 	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
 	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
 )
 
 // BasicSubscription can subscribe to kafka topics and handle task to task runner
 type BasicSubscription struct {
+	// heartbeat is the unix nano time when the subscription last made progress, accessed atomically
+	heartbeat  int64
 	config     *SubscriptionConfig
 	rule       utils.RuleConfig
 	mutex      sync.Mutex
 	consumer   *kafka.Consumer
 	subscribed bool
 	stopChan   chan bool
-	limiter    *rate.RateLimiter
+	doneChan   chan bool
+	// controlChan runs functions in the consume loop, when no message is being polled
+	controlChan chan func()
+	limiter     *rate.RateLimiter
+	filter      *filter.Filter
+	workers     *workerPool
+	// offsetMutex guards offsets and the order of storing offsets
+	offsetMutex sync.Mutex
+	offsets     *offsetTracker
+	// statusMutex guards the fields below, which may be accessed by rebalance callbacks and workers
+	statusMutex   sync.Mutex
+	executor      task.Executor
+	paused        bool
+	lastErr       error
+	lastErrorTime time.Time
+	// abortChan is closed to give up retrying messages when workers are waited for
+	abortChan chan struct{}
 }
 
 func (sub *BasicSubscription) topics() []string {
@@ -35,20 +60,32 @@ func (sub *BasicSubscription) Subscribe() error {
 	}
 
 	var err error
+	sub.filter, err = compileFilter(sub.rule)
+	if err != nil {
+		return err
+	}
+	if err = sub.resetExecutor(); err != nil {
+		return err
+	}
+	// offsets are stored and committed only after messages are handled
 	sub.consumer, err = kafka.NewConsumer(&kafka.ConfigMap{
-		"bootstrap.servers": sub.config.BrokerList,
-		"group.id":          sub.config.GroupIDPrefix + sub.rule.Name,
-		"auto.offset.reset": "earliest",
+		"bootstrap.servers":        sub.config.BrokerList,
+		"group.id":                 sub.config.GroupIDPrefix + sub.rule.Name,
+		"auto.offset.reset":        "earliest",
+		"enable.auto.commit":       false,
+		"enable.auto.offset.store": false,
 	})
 	if err != nil {
 		return err
 	}
 	topics := sub.topics()
-	err = sub.consumer.SubscribeTopics(topics, nil)
+	err = sub.consumer.SubscribeTopics(topics, sub.rebalance)
 	if err != nil {
 		return err
 	}
 	sub.stopChan = make(chan bool, 1)
+	sub.doneChan = make(chan bool)
+	sub.controlChan = make(chan func())
 	sub.subscribed = true
 	if sub.rule.RateLimit > 0 {
 		if sub.rule.RateInterval == 0 {
@@ -56,6 +93,10 @@ func (sub *BasicSubscription) Subscribe() error {
 		}
 		sub.limiter = rate.New(sub.rule.RateLimit, time.Duration(sub.rule.RateInterval)*time.Millisecond)
 	}
+	sub.offsets = newOffsetTracker()
+	sub.abortChan = make(chan struct{})
+	sub.workers = newWorkerPool(sub.rule.Concurrency, sub.work)
+	sub.beat()
 	go sub.consume()
 	log.Infof("subscribed to %v, rule: %v", topics, sub.rule.Name)
 	return nil
@@ -69,19 +110,27 @@ func (sub *BasicSubscription) consume() {
 			sub.subscribed = false
 			sub.mutex.Unlock()
 			break
+		case f := <-sub.controlChan:
+			f()
 		default:
+			sub.beat()
 			ev := sub.consumer.Poll(100)
 			if ev == nil {
 				continue
 			}
 			switch e := ev.(type) {
 			case *kafka.Message:
+				metrics.MessagesConsumed.WithLabelValues(sub.rule.Name, *e.TopicPartition.Topic).Inc()
+				sub.updateLag(e.TopicPartition)
 				if sub.limiter != nil {
+					start := time.Now()
 					sub.limiter.Wait()
+					metrics.RateLimitWait.WithLabelValues(sub.rule.Name).Observe(time.Since(start).Seconds())
 				}
-				sub.mutex.Lock()
-				sub.handleMessage(e)
-				sub.mutex.Unlock()
+				sub.offsetMutex.Lock()
+				sub.offsets.add(e.TopicPartition)
+				sub.offsetMutex.Unlock()
+				sub.workers.dispatch(sub.messageKey(e), e)
 			case *kafka.Error:
 				if e.Code() == kafka.ErrAllBrokersDown {
 					log.WithError(e).Fatal("kafka all broker down")
@@ -94,30 +143,455 @@ func (sub *BasicSubscription) consume() {
 			}
 		}
 	}
+	sub.abortRetries(sub.workers.stop)
+	sub.statusMutex.Lock()
+	executor := sub.executor
+	sub.statusMutex.Unlock()
+	// executors may send pending work of handled messages, e.g. batched purges, before the final commit
+	sub.closeExecutor(executor)
 	sub.mutex.Lock()
+	sub.commit()
 	err := sub.consumer.Close()
 	if err != nil {
 		log.WithError(err).Warn("close consumer failed")
 	}
 	sub.stopChan = nil
+	close(sub.doneChan)
 	sub.mutex.Unlock()
 }
 
+func (sub *BasicSubscription) rebalance(c *kafka.Consumer, ev kafka.Event) error {
+	switch e := ev.(type) {
+	case kafka.AssignedPartitions:
+		log.WithField("rule", sub.rule.Name).Infof("partitions assigned: %v", e.Partitions)
+		if err := c.Assign(e.Partitions); err != nil {
+			return err
+		}
+		sub.statusMutex.Lock()
+		paused := sub.paused
+		sub.statusMutex.Unlock()
+		if paused {
+			return c.Pause(e.Partitions)
+		}
+		return nil
+	case kafka.RevokedPartitions:
+		// finish and commit dispatched messages before the partitions are taken by other consumers
+		sub.abortRetries(sub.workers.wait)
+		sub.commit()
+		sub.offsetMutex.Lock()
+		sub.offsets.remove(e.Partitions)
+		sub.offsetMutex.Unlock()
+		for _, tp := range e.Partitions {
+			metrics.ConsumerLag.DeleteLabelValues(sub.rule.Name, *tp.Topic, strconv.Itoa(int(tp.Partition)))
+		}
+		log.WithField("rule", sub.rule.Name).Infof("partitions revoked: %v", e.Partitions)
+		return c.Unassign()
+	}
+	return nil
+}
+
+// updateLag sets the consumer lag of a partition with the cached high watermark
+func (sub *BasicSubscription) updateLag(tp kafka.TopicPartition) {
+	_, high, err := sub.consumer.GetWatermarkOffsets(*tp.Topic, tp.Partition)
+	if err != nil || high < 0 {
+		return
+	}
+	lag := high - int64(tp.Offset) - 1
+	if lag < 0 {
+		lag = 0
+	}
+	metrics.ConsumerLag.WithLabelValues(sub.rule.Name, *tp.Topic, strconv.Itoa(int(tp.Partition))).Set(float64(lag))
+}
+
+// messageKey decides which worker handles a message, messages with the same key are handled in order
+func (sub *BasicSubscription) messageKey(km *kafka.Message) string {
+	switch sub.rule.ConcurrencyKey {
+	case "", "partition":
+	case "key":
+		if len(km.Key) > 0 {
+			return string(km.Key)
+		}
+	default:
+		if key := gjson.GetBytes(km.Value, sub.rule.ConcurrencyKey).String(); key != "" {
+			return key
+		}
+	}
+	return *km.TopicPartition.Topic + ":" + strconv.Itoa(int(km.TopicPartition.Partition))
+}
+
+func (sub *BasicSubscription) work(km *kafka.Message) {
+	// a message neither executed nor dead-lettered keeps its offset uncommitted, and is retried after a pause
+	wait := time.Second
+	for sub.handleMessage(km) != nil {
+		sub.offsetMutex.Lock()
+		sub.offsets.fail(km.TopicPartition)
+		sub.offsetMutex.Unlock()
+		sub.statusMutex.Lock()
+		abortChan := sub.abortChan
+		sub.statusMutex.Unlock()
+		select {
+		case <-time.After(wait):
+		case <-abortChan:
+			// the message is consumed again after the partition is assigned or the consumer restarts
+			return
+		}
+		if wait *= 2; wait > time.Minute {
+			wait = time.Minute
+		}
+	}
+	sub.beat()
+
+	// only the low-water mark of handled messages is committed, so no unhandled message is skipped after a restart
+	sub.offsetMutex.Lock()
+	tp, advanced := sub.offsets.done(km.TopicPartition)
+	if advanced {
+		sub.storeOffset(tp)
+	}
+	sub.offsetMutex.Unlock()
+	if advanced {
+		sub.commit()
+	}
+}
+
+// abortRetries gives up retrying messages while waiting for workers, the messages are left uncommitted
+func (sub *BasicSubscription) abortRetries(wait func()) {
+	sub.statusMutex.Lock()
+	close(sub.abortChan)
+	sub.statusMutex.Unlock()
+	wait()
+	sub.statusMutex.Lock()
+	sub.abortChan = make(chan struct{})
+	sub.statusMutex.Unlock()
+}
+
+// abortWork gives up retrying messages and waits for workers, partitions with messages left unhandled are no longer
+// tracked, and returned with their lowest unhandled offsets to consume again from there
+func (sub *BasicSubscription) abortWork() []kafka.TopicPartition {
+	sub.abortRetries(sub.workers.wait)
+	sub.offsetMutex.Lock()
+	defer sub.offsetMutex.Unlock()
+	unhandled := sub.offsets.unhandled()
+	sub.offsets.remove(unhandled)
+	return unhandled
+}
+
+// storeOffset stores the next offset to consume in a partition, it will be committed in the next commit
+func (sub *BasicSubscription) storeOffset(tp kafka.TopicPartition) {
+	if _, err := sub.consumer.StoreOffsets([]kafka.TopicPartition{tp}); err != nil {
+		log.WithError(err).WithField("rule", sub.rule.Name).Warn("store offset failed")
+	}
+}
+
+func (sub *BasicSubscription) commit() {
+	_, err := sub.consumer.Commit()
+	if kerr, ok := err.(kafka.Error); ok && kerr.Code() == kafka.ErrNoOffset {
+		return
+	}
+	if err != nil {
+		log.WithError(err).WithField("rule", sub.rule.Name).Warn("commit offset failed")
+	}
+}
+
+// handleMessage executes a message and sends it to the dead-letter topic if it fails,
+// an error is returned if the message is neither executed nor dead-lettered
 func (sub *BasicSubscription) handleMessage(km *kafka.Message) error {
-	executor := task.TypeFromString(sub.rule.TaskType).GetExecutor()
+	if sub.filter != nil && !sub.filter.Match(km.Value) {
+		log.WithField("rule", sub.rule.Name).WithField("offset", km.TopicPartition.Offset).Debug("message skipped by filter")
+		metrics.MessagesFiltered.WithLabelValues(sub.rule.Name).Inc()
+		return nil
+	}
+	sub.statusMutex.Lock()
+	executor := sub.executor
+	sub.statusMutex.Unlock()
+	start := time.Now()
 	err := executor.Execute(km.Value)
+	metrics.ExecuteDuration.WithLabelValues(task.NormalizeType(sub.rule.TaskType), metrics.Outcome(err)).Observe(time.Since(start).Seconds())
 	if err != nil {
-		log.WithError(err).Warn("execute message error")
+		log.WithError(err).WithField("rule", sub.rule.Name).WithField("permanent", task.Permanent(err)).Warn("execute message error")
+		sub.statusMutex.Lock()
+		sub.lastErr = err
+		sub.lastErrorTime = time.Now()
+		sub.statusMutex.Unlock()
+		return sub.deadLetter(km, err)
 	}
-	return err
+	return nil
 }
 
-// Unsubscribe stops polling messages
-func (sub *BasicSubscription) Unsubscribe() {
+// deadLetter sends a failed message to the dead-letter topic, failed messages are skipped if the rule has no dead-letter topic
+func (sub *BasicSubscription) deadLetter(km *kafka.Message, err error) error {
+	if sub.rule.DeadLetterTopic == "" {
+		return nil
+	}
+	logger := log.WithField("rule", sub.rule.Name).WithField("topic", sub.rule.DeadLetterTopic)
+	if sub.config.Producer == nil {
+		logger.Error("no producer for dead-letter topic")
+		return errors.New("no producer for dead-letter topic")
+	}
+	err = produceMessage(sub.config.Producer, deadLetterMessage(sub.rule.DeadLetterTopic, km, sub.rule.Name, err))
+	metrics.DeadLetters.WithLabelValues(sub.rule.Name, metrics.Outcome(err)).Inc()
+	if err != nil {
+		logger.WithError(err).Error("produce dead-letter message failed")
+		return err
+	}
+	logger.WithField("offset", km.TopicPartition.Offset).Info("message sent to dead-letter topic")
+	return nil
+}
+
+func (sub *BasicSubscription) beat() {
+	atomic.StoreInt64(&sub.heartbeat, time.Now().UnixNano())
+}
+
+// Alive returns an error if neither the consume loop nor the workers made progress within the liveness timeout
+func (sub *BasicSubscription) Alive() error {
+	if sub.config.LivenessTimeout <= 0 {
+		return nil
+	}
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+	if !sub.subscribed {
+		return nil
+	}
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&sub.heartbeat)))
+	if idle > sub.config.LivenessTimeout {
+		return fmt.Errorf("rule %v made no progress in %v", sub.rule.Name, idle)
+	}
+	return nil
+}
+
+// Ready returns an error if the subscription is not subscribed, has no assigned partition,
+// or has a failed message which can't be sent to the dead-letter topic
+func (sub *BasicSubscription) Ready() error {
 	sub.mutex.Lock()
 	defer sub.mutex.Unlock()
 	if !sub.subscribed {
+		return fmt.Errorf("rule %v is not subscribed", sub.rule.Name)
+	}
+	sub.offsetMutex.Lock()
+	failed := sub.offsets.hasFailed()
+	sub.offsetMutex.Unlock()
+	if failed {
+		return fmt.Errorf("rule %v has failed messages not sent to the dead-letter topic", sub.rule.Name)
+	}
+	partitions, err := sub.consumer.Assignment()
+	if err != nil {
+		return err
+	}
+	if len(partitions) == 0 {
+		return fmt.Errorf("rule %v has no assigned partition", sub.rule.Name)
+	}
+	return nil
+}
+
+// resetExecutor creates the executor of the rule again with the current configuration
+func (sub *BasicSubscription) resetExecutor() error {
+	executor, err := newExecutor(sub.rule)
+	if err != nil {
+		return err
+	}
+	sub.statusMutex.Lock()
+	previous := sub.executor
+	sub.executor = executor
+	sub.statusMutex.Unlock()
+	if previous != nil {
+		sub.closeExecutor(previous)
+	}
+	return nil
+}
+
+func (sub *BasicSubscription) closeExecutor(executor task.Executor) {
+	if err := task.Close(executor); err != nil {
+		log.WithError(err).WithField("rule", sub.rule.Name).Warn("close executor failed")
+	}
+}
+
+// Status returns the runtime status of the rule
+func (sub *BasicSubscription) Status() RuleStatus {
+	sub.statusMutex.Lock()
+	status := RuleStatus{
+		Name:       sub.rule.Name,
+		TaskType:   task.NormalizeType(sub.rule.TaskType),
+		Topics:     sub.topics(),
+		Paused:     sub.paused,
+		Partitions: []PartitionStatus{},
+	}
+	if sub.lastErr != nil {
+		lastErrorTime := sub.lastErrorTime
+		status.LastError = sub.lastErr.Error()
+		status.LastErrorTime = &lastErrorTime
+	}
+	sub.statusMutex.Unlock()
+
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+	status.Subscribed = sub.subscribed
+	if !sub.subscribed {
+		return status
+	}
+	partitions, err := sub.consumer.Assignment()
+	if err != nil || len(partitions) == 0 {
+		return status
+	}
+	committed, err := sub.consumer.Committed(partitions, 5000)
+	if err != nil {
+		log.WithError(err).WithField("rule", sub.rule.Name).Warn("get committed offsets failed")
+		committed = partitions
+	}
+	for _, tp := range committed {
+		ps := PartitionStatus{Topic: *tp.Topic, Partition: tp.Partition, Committed: int64(tp.Offset), High: -1, Lag: -1}
+		if _, high, err := sub.consumer.GetWatermarkOffsets(*tp.Topic, tp.Partition); err == nil && high >= 0 {
+			ps.High = high
+			if tp.Offset >= 0 {
+				ps.Lag = high - int64(tp.Offset)
+			}
+		}
+		status.Partitions = append(status.Partitions, ps)
+	}
+	return status
+}
+
+// Pause stops fetching messages from the assigned partitions, partitions assigned later are paused as well
+func (sub *BasicSubscription) Pause() error {
+	return sub.setPaused(true)
+}
+
+// Resume continues fetching messages from the assigned partitions
+func (sub *BasicSubscription) Resume() error {
+	return sub.setPaused(false)
+}
+
+func (sub *BasicSubscription) setPaused(paused bool) error {
+	sub.statusMutex.Lock()
+	sub.paused = paused
+	sub.statusMutex.Unlock()
+
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+	if !sub.subscribed {
+		return nil
+	}
+	partitions, err := sub.consumer.Assignment()
+	if err != nil {
+		return err
+	}
+	if paused {
+		err = sub.consumer.Pause(partitions)
+	} else {
+		err = sub.consumer.Resume(partitions)
+	}
+	if err != nil {
+		return err
+	}
+	log.WithField("rule", sub.rule.Name).WithField("paused", paused).Info("rule paused state changed")
+	return nil
+}
+
+// ResetOffsets commits new offsets for the assigned partitions and consumes from there
+func (sub *BasicSubscription) ResetOffsets(reset OffsetReset) error {
+	sub.mutex.Lock()
+	if !sub.subscribed {
+		sub.mutex.Unlock()
+		return fmt.Errorf("rule %v is not subscribed", sub.rule.Name)
+	}
+	controlChan, doneChan := sub.controlChan, sub.doneChan
+	sub.mutex.Unlock()
+
+	// the reset runs in the consume loop, so no message is dispatched meanwhile
+	result := make(chan error, 1)
+	select {
+	case controlChan <- func() { result <- sub.resetOffsets(reset) }:
+	case <-doneChan:
+		return fmt.Errorf("rule %v is not subscribed", sub.rule.Name)
+	}
+	select {
+	case err := <-result:
+		return err
+	case <-doneChan:
+		return fmt.Errorf("rule %v is not subscribed", sub.rule.Name)
+	}
+}
+
+func (sub *BasicSubscription) resetOffsets(reset OffsetReset) error {
+	// dispatched messages must not commit their offsets after the reset,
+	// messages whose retries are aborted are consumed again, including those of partitions not being reset
+	for _, tp := range sub.abortWork() {
+		if err := sub.consumer.Seek(tp, 5000); err != nil {
+			return err
+		}
+	}
+
+	partitions, err := sub.consumer.Assignment()
+	if err != nil {
+		return err
+	}
+	targets := []kafka.TopicPartition{}
+	for _, tp := range partitions {
+		if (reset.Topic != "" && *tp.Topic != reset.Topic) || (reset.Partition >= 0 && tp.Partition != reset.Partition) {
+			continue
+		}
+		tp.Offset, err = sub.resetOffset(tp, reset)
+		if err != nil {
+			return err
+		}
+		targets = append(targets, tp)
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("rule %v has no assigned partition to reset", sub.rule.Name)
+	}
+
+	// offsets are stored rather than committed directly, so a later commit won't restore the previous offsets
+	if _, err := sub.consumer.StoreOffsets(targets); err != nil {
+		return err
+	}
+	if _, err := sub.consumer.Commit(); err != nil {
+		return err
+	}
+	for _, tp := range targets {
+		if err := sub.consumer.Seek(tp, 5000); err != nil {
+			return err
+		}
+	}
+	log.WithField("rule", sub.rule.Name).Infof("offsets reset: %v", targets)
+	return nil
+}
+
+func (sub *BasicSubscription) resetOffset(tp kafka.TopicPartition, reset OffsetReset) (kafka.Offset, error) {
+	low, high, err := sub.consumer.QueryWatermarkOffsets(*tp.Topic, tp.Partition, 5000)
+	if err != nil {
+		return 0, err
+	}
+	switch reset.To {
+	case "earliest":
+		return kafka.Offset(low), nil
+	case "latest":
+		return kafka.Offset(high), nil
+	case "time":
+		tp.Offset = kafka.Offset(reset.Time.UnixNano() / int64(time.Millisecond))
+		offsets, err := sub.consumer.OffsetsForTimes([]kafka.TopicPartition{tp}, 5000)
+		if err != nil {
+			return 0, err
+		}
+		if len(offsets) == 0 || offsets[0].Offset < 0 {
+			return kafka.Offset(high), nil
+		}
+		return offsets[0].Offset, nil
+	case "offset":
+		if reset.Offset < low || reset.Offset > high {
+			return 0, fmt.Errorf("offset %v out of range [%v, %v] in %v", reset.Offset, low, high, tp)
+		}
+		return kafka.Offset(reset.Offset), nil
+	}
+	return 0, fmt.Errorf("invalid offset reset: %v", reset.To)
+}
+
+// Unsubscribe stops polling messages, and waits until handled messages are committed and the consumer is closed
+func (sub *BasicSubscription) Unsubscribe() {
+	sub.mutex.Lock()
+	if !sub.subscribed {
+		sub.mutex.Unlock()
 		return
 	}
 	sub.stopChan <- true
+	doneChan := sub.doneChan
+	sub.mutex.Unlock()
+	<-doneChan
 }
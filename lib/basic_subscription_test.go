@@ -0,0 +1,100 @@
+package lib
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mudkipme/timburr/utils"
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+)
+
+// failingExecutor fails messages in its partition, and signals each failure
+type failingExecutor struct {
+	failures chan string
+}
+
+func (e *failingExecutor) Execute(message []byte) error {
+	if string(message) == "fail" {
+		select {
+		case e.failures <- string(message):
+		default:
+		}
+		return errors.New("job runner unavailable")
+	}
+	return nil
+}
+
+func testMessage(partition int32, offset kafka.Offset, value string) *kafka.Message {
+	return &kafka.Message{TopicPartition: topicPartition("jobs", partition, offset), Value: []byte(value)}
+}
+
+func TestAbortWork(t *testing.T) {
+	consumer, err := kafka.NewConsumer(&kafka.ConfigMap{"bootstrap.servers": "127.0.0.1:1", "group.id": "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.Close()
+	executor := &failingExecutor{failures: make(chan string, 1)}
+	// failed messages are retried since the dead-letter topic has no producer
+	sub := &BasicSubscription{
+		rule:      utils.RuleConfig{Name: "jobs", DeadLetterTopic: "jobs-dead-letter"},
+		config:    &SubscriptionConfig{},
+		consumer:  consumer,
+		executor:  executor,
+		offsets:   newOffsetTracker(),
+		abortChan: make(chan struct{}),
+	}
+	sub.workers = newWorkerPool(1, sub.work)
+
+	// a message of partition 1 keeps retrying while partition 0 is reset
+	for _, km := range []*kafka.Message{testMessage(0, 3, "ok"), testMessage(1, 5, "fail"), testMessage(1, 6, "ok")} {
+		sub.offsetMutex.Lock()
+		sub.offsets.add(km.TopicPartition)
+		sub.offsetMutex.Unlock()
+		sub.workers.dispatch(sub.messageKey(km), km)
+	}
+	select {
+	case <-executor.failures:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the message is not executed")
+	}
+
+	done := make(chan []kafka.TopicPartition)
+	go func() { done <- sub.abortWork() }()
+	var unhandled []kafka.TopicPartition
+	select {
+	case unhandled = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("workers are not stopped")
+	}
+
+	// the retrying message is consumed again from its offset, instead of stranding the partition
+	if len(unhandled) != 1 || unhandled[0].Partition != 1 || unhandled[0].Offset != 5 {
+		t.Errorf("abortWork() = %v, want jobs [1] at offset 5", unhandled)
+	}
+	sub.offsetMutex.Lock()
+	tracked := len(sub.offsets.partitions)
+	sub.offsetMutex.Unlock()
+	if tracked != 0 {
+		t.Error("partitions are still tracked after the workers are aborted")
+	}
+
+	// retries work again after the reset
+	km := testMessage(1, 5, "fail")
+	sub.offsetMutex.Lock()
+	sub.offsets.add(km.TopicPartition)
+	sub.offsetMutex.Unlock()
+	sub.workers.dispatch(sub.messageKey(km), km)
+	select {
+	case <-executor.failures:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the message is not executed")
+	}
+	select {
+	case <-executor.failures:
+		t.Error("the message is retried without a pause")
+	case <-time.After(500 * time.Millisecond):
+	}
+	sub.abortRetries(sub.workers.stop)
+}
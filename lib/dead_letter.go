@@ -0,0 +1,60 @@
+package lib
+
+import (
+	"strconv"
+
+	"github.com/mudkipme/timburr/lib/task"
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+)
+
+// Headers added to messages produced to a dead-letter topic
+const (
+	HeaderOriginalTopic     = "timburr-original-topic"
+	HeaderOriginalPartition = "timburr-original-partition"
+	HeaderOriginalOffset    = "timburr-original-offset"
+	HeaderRule              = "timburr-rule"
+	HeaderError             = "timburr-error"
+	HeaderAttempts          = "timburr-attempts"
+	HeaderPermanent         = "timburr-permanent"
+)
+
+func deadLetterMessage(topic string, km *kafka.Message, ruleName string, err error) *kafka.Message {
+	headers := append([]kafka.Header{}, km.Headers...)
+	headers = append(headers,
+		kafka.Header{Key: HeaderOriginalTopic, Value: []byte(*km.TopicPartition.Topic)},
+		kafka.Header{Key: HeaderOriginalPartition, Value: []byte(strconv.FormatInt(int64(km.TopicPartition.Partition), 10))},
+		kafka.Header{Key: HeaderOriginalOffset, Value: []byte(strconv.FormatInt(int64(km.TopicPartition.Offset), 10))},
+		kafka.Header{Key: HeaderRule, Value: []byte(ruleName)},
+		kafka.Header{Key: HeaderError, Value: []byte(err.Error())},
+		kafka.Header{Key: HeaderAttempts, Value: []byte(strconv.Itoa(task.Attempts(err)))},
+		kafka.Header{Key: HeaderPermanent, Value: []byte(strconv.FormatBool(task.Permanent(err)))},
+	)
+	return &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+		Key:            km.Key,
+		Value:          km.Value,
+		Headers:        headers,
+	}
+}
+
+// headerValue returns the last value of a header, which is the latest one if a message has been dead-lettered several times
+func headerValue(km *kafka.Message, key string) (string, bool) {
+	for i := len(km.Headers) - 1; i >= 0; i-- {
+		if km.Headers[i].Key == key {
+			return string(km.Headers[i].Value), true
+		}
+	}
+	return "", false
+}
+
+// produceMessage produces a message and waits for the delivery report
+func produceMessage(producer *kafka.Producer, msg *kafka.Message) error {
+	deliveryChan := make(chan kafka.Event, 1)
+	defer close(deliveryChan)
+	if err := producer.Produce(msg, deliveryChan); err != nil {
+		return err
+	}
+	e := <-deliveryChan
+	m := e.(*kafka.Message)
+	return m.TopicPartition.Error
+}
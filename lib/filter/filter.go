@@ -0,0 +1,234 @@
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/tidwall/gjson"
+)
+
+// Filter is a compiled filter expression which can be evaluated against a JSON message
+//
+// A filter expression is made of gjson paths and literals, combined with these operators:
+//
+//	==, !=          equality, e.g. meta.domain == "wiki.52poke.com"
+//	=~, !~          regular expression match, e.g. type =~ "^cirrusSearch"
+//	<, <=, >, >=    numeric comparison, e.g. params.count > 100
+//	in              membership, e.g. type in ["refreshLinks", "htmlCacheUpdate"]
+//	&&, ||, !, ( )  boolean combinators
+//
+// A path alone is true when it exists and is not false, null, 0 or an empty string.
+// Paths containing special characters can be quoted with backticks.
+type Filter struct {
+	expr string
+	root node
+}
+
+// Compile parses a filter expression
+func Compile(expr string) (*Filter, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, fmt.Errorf("filter: unexpected %q at position %d", t.text, t.pos)
+	}
+	return &Filter{expr: expr, root: root}, nil
+}
+
+// Match reports whether the JSON message satisfies the filter
+func (f *Filter) Match(message []byte) bool {
+	return f.root.eval(message)
+}
+
+func (f *Filter) String() string {
+	return f.expr
+}
+
+type node interface {
+	eval(message []byte) bool
+}
+
+type andNode struct {
+	left, right node
+}
+
+func (n *andNode) eval(message []byte) bool {
+	return n.left.eval(message) && n.right.eval(message)
+}
+
+type orNode struct {
+	left, right node
+}
+
+func (n *orNode) eval(message []byte) bool {
+	return n.left.eval(message) || n.right.eval(message)
+}
+
+type notNode struct {
+	operand node
+}
+
+func (n *notNode) eval(message []byte) bool {
+	return !n.operand.eval(message)
+}
+
+type truthNode struct {
+	operand operand
+}
+
+func (n *truthNode) eval(message []byte) bool {
+	return n.operand.value(message).truthy()
+}
+
+type compareNode struct {
+	op          string
+	left, right operand
+}
+
+func (n *compareNode) eval(message []byte) bool {
+	l, r := n.left.value(message), n.right.value(message)
+	switch n.op {
+	case "==":
+		return l.equal(r)
+	case "!=":
+		return !l.equal(r)
+	}
+	lf, lok := l.number()
+	rf, rok := r.number()
+	if !lok || !rok {
+		return false
+	}
+	switch n.op {
+	case "<":
+		return lf < rf
+	case "<=":
+		return lf <= rf
+	case ">":
+		return lf > rf
+	case ">=":
+		return lf >= rf
+	}
+	return false
+}
+
+type matchNode struct {
+	negate  bool
+	operand operand
+	re      *regexp.Regexp
+}
+
+func (n *matchNode) eval(message []byte) bool {
+	v := n.operand.value(message)
+	matched := v.kind != kindNull && n.re.MatchString(v.str)
+	return matched != n.negate
+}
+
+type inNode struct {
+	operand operand
+	list    []value
+}
+
+func (n *inNode) eval(message []byte) bool {
+	v := n.operand.value(message)
+	for _, item := range n.list {
+		if v.equal(item) {
+			return true
+		}
+	}
+	return false
+}
+
+// operand is either a gjson path or a literal value
+type operand interface {
+	value(message []byte) value
+}
+
+type pathOperand string
+
+func (p pathOperand) value(message []byte) value {
+	return valueFromResult(gjson.GetBytes(message, string(p)))
+}
+
+type literalOperand value
+
+func (l literalOperand) value(message []byte) value {
+	return value(l)
+}
+
+type valueKind int
+
+const (
+	kindNull valueKind = iota
+	kindBool
+	kindNumber
+	kindString
+	kindJSON
+)
+
+type value struct {
+	kind valueKind
+	str  string
+	num  float64
+	b    bool
+}
+
+func valueFromResult(r gjson.Result) value {
+	switch r.Type {
+	case gjson.True, gjson.False:
+		return value{kind: kindBool, b: r.Bool(), str: r.String()}
+	case gjson.Number:
+		return value{kind: kindNumber, num: r.Num, str: r.Raw}
+	case gjson.String:
+		return value{kind: kindString, str: r.Str}
+	case gjson.JSON:
+		return value{kind: kindJSON, str: r.Raw}
+	}
+	return value{kind: kindNull}
+}
+
+func (v value) equal(o value) bool {
+	if v.kind != o.kind {
+		return false
+	}
+	switch v.kind {
+	case kindNull:
+		return true
+	case kindBool:
+		return v.b == o.b
+	case kindNumber:
+		return v.num == o.num
+	}
+	return v.str == o.str
+}
+
+func (v value) number() (float64, bool) {
+	switch v.kind {
+	case kindNumber:
+		return v.num, true
+	case kindString:
+		f, err := strconv.ParseFloat(v.str, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func (v value) truthy() bool {
+	switch v.kind {
+	case kindBool:
+		return v.b
+	case kindNumber:
+		return v.num != 0
+	case kindString:
+		return v.str != ""
+	case kindJSON:
+		return true
+	}
+	return false
+}
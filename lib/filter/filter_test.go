@@ -0,0 +1,139 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+)
+
+const message = `{
+	"type": "refreshLinks",
+	"database": "zhwiki",
+	"meta": {"domain": "wiki.52poke.com", "dt": "2020-06-01T00:00:00Z"},
+	"params": {"count": 150, "namespace": 0, "recursive": true, "size": "42", "title": ""},
+	"page_namespace": 0,
+	"tags": ["a", "b"],
+	"mediawiki.event": "edit",
+	"user name": "Pikachu",
+	"empty": null
+}`
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		// equality
+		{`type == "refreshLinks"`, true},
+		{`type != "refreshLinks"`, false},
+		{`meta.domain == "wiki.52poke.com"`, true},
+		{`params.count == 150`, true},
+		{`params.count == 150.0`, true},
+		{`params.recursive == true`, true},
+		{`empty == null`, true},
+		{`missing == null`, true},
+		{`missing != null`, false},
+
+		// type mismatches never equal, and only numbers and numeric strings compare
+		{`params.count == "150"`, false},
+		{`params.size == 42`, false},
+		{`params.recursive == "true"`, false},
+		{`params.size > 40`, true},
+		{`type > 1`, false},
+		{`type < 1`, false},
+		{`missing >= 0`, false},
+		{`params.recursive > 0`, false},
+
+		// numeric comparison
+		{`params.count > 100`, true},
+		{`params.count >= 150`, true},
+		{`params.count < 150`, false},
+		{`params.count <= 150`, true},
+		{`params.count > -1`, true},
+		{`params.count < 1e3`, true},
+
+		// truth of a path alone
+		{`params.recursive`, true},
+		{`params.namespace`, false},
+		{`params.title`, false},
+		{`params`, true},
+		{`missing`, false},
+		{`empty`, false},
+
+		// regular expressions
+		{`type =~ "^refresh"`, true},
+		{`type =~ "^cirrusSearch"`, false},
+		{`type !~ "^cirrusSearch"`, true},
+		{`meta.domain =~ "\\.52poke\\.com$"`, true},
+		{`params.count =~ "^15"`, true},
+		{`missing =~ ".*"`, false},
+		{`missing !~ "x"`, true},
+
+		// membership
+		{`type in ["refreshLinks", "htmlCacheUpdate"]`, true},
+		{`type in ["htmlCacheUpdate"]`, false},
+		{`type in []`, false},
+		{`page_namespace in [0, 2, 4]`, true},
+		{`page_namespace in ["0"]`, false},
+		{`missing in [null]`, true},
+
+		// backtick paths
+		{"`user name` == \"Pikachu\"", true},
+		{"`user name` != \"Pikachu\" || `meta.dt` =~ \"^2020\"", true},
+		{"`mediawiki\\.event` == \"edit\"", true},
+		{"mediawiki.event == \"edit\"", false},
+
+		// precedence: ! binds tighter than &&, which binds tighter than ||
+		{`!params.recursive || type == "refreshLinks"`, true},
+		{`!(params.recursive || type == "refreshLinks")`, false},
+		{`!params.namespace && params.recursive`, true},
+		{`type == "x" && params.recursive || params.count > 100`, true},
+		{`type == "x" && (params.recursive || params.count > 100)`, false},
+		{`params.count > 100 || type == "x" && params.recursive == false`, true},
+		{`(params.count > 100 || type == "x") && params.recursive == false`, false},
+		{`!!params.recursive`, true},
+		{`! type in ["refreshLinks"]`, false},
+	}
+	for _, tt := range tests {
+		f, err := Compile(tt.expr)
+		if err != nil {
+			t.Errorf("Compile(%q) error: %v", tt.expr, err)
+			continue
+		}
+		if got := f.Match([]byte(message)); got != tt.want {
+			t.Errorf("%q matched %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestCompileError(t *testing.T) {
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{``, "unexpected end of expression"},
+		{`type ==`, "unexpected end of expression"},
+		{`type == "refreshLinks`, "unterminated string"},
+		{"`type == 1", "unterminated path"},
+		{`(type == 1`, "unexpected end of expression"},
+		{`type == 1)`, `unexpected ")"`},
+		{`type == 1 &&`, "unexpected end of expression"},
+		{`type =~ typeName`, "expects a string pattern"},
+		{`type =~ "("`, "invalid pattern"},
+		{`type in "a"`, `unexpected "a"`},
+		{`type in ["a" "b"]`, `unexpected "b"`},
+		{`type in [params]`, `unexpected "params"`},
+		{`type $ 1`, "unexpected character"},
+		{`count == 1.2.3`, "invalid number"},
+		{`type == 1 type`, `unexpected "type"`},
+	}
+	for _, tt := range tests {
+		_, err := Compile(tt.expr)
+		if err == nil {
+			t.Errorf("Compile(%q) succeeded, want error", tt.expr)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Compile(%q) error %q, want %q", tt.expr, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenPath
+	tokenString
+	tokenNumber
+	tokenKeyword
+	tokenOperator
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+var operators = []string{"&&", "||", "==", "!=", "=~", "!~", "<=", ">=", "<", ">", "!", "(", ")", "[", "]", ","}
+
+func isPathChar(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("_.-@#*?\\:", r)
+}
+
+func tokenize(expr string) ([]token, error) {
+	tokens := []token{}
+	runes := []rune(expr)
+	i := 0
+	for i < len(runes) {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '"':
+			start := i
+			i++
+			for i < len(runes) && runes[i] != '"' {
+				if runes[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("filter: unterminated string at position %d", start)
+			}
+			i++
+			s, err := strconv.Unquote(string(runes[start:i]))
+			if err != nil {
+				return nil, fmt.Errorf("filter: invalid string at position %d: %v", start, err)
+			}
+			tokens = append(tokens, token{kind: tokenString, text: s, pos: start})
+		case r == '`':
+			start := i
+			i++
+			for i < len(runes) && runes[i] != '`' {
+				i++
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("filter: unterminated path at position %d", start)
+			}
+			tokens = append(tokens, token{kind: tokenPath, text: string(runes[start+1 : i]), pos: start})
+			i++
+		case unicode.IsDigit(r) || (r == '-' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			start := i
+			i++
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || strings.ContainsRune(".eE+-", runes[i])) {
+				i++
+			}
+			text := string(runes[start:i])
+			if _, err := strconv.ParseFloat(text, 64); err != nil {
+				return nil, fmt.Errorf("filter: invalid number %q at position %d", text, start)
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: text, pos: start})
+		case isPathChar(r):
+			start := i
+			for i < len(runes) && isPathChar(runes[i]) {
+				i++
+			}
+			text := string(runes[start:i])
+			kind := tokenPath
+			switch text {
+			case "in", "true", "false", "null":
+				kind = tokenKeyword
+			}
+			tokens = append(tokens, token{kind: kind, text: text, pos: start})
+		default:
+			matched := false
+			for _, op := range operators {
+				if strings.HasPrefix(string(runes[i:]), op) {
+					tokens = append(tokens, token{kind: tokenOperator, text: op, pos: i})
+					i += len([]rune(op))
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("filter: unexpected character %q at position %d", r, i)
+			}
+		}
+	}
+	tokens = append(tokens, token{kind: tokenEOF, pos: len(runes)})
+	return tokens, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) accept(kind tokenKind, text string) bool {
+	if t := p.peek(); t.kind == kind && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(kind tokenKind, text string) error {
+	if !p.accept(kind, text) {
+		return p.unexpected()
+	}
+	return nil
+}
+
+func (p *parser) unexpected() error {
+	t := p.peek()
+	if t.kind == tokenEOF {
+		return fmt.Errorf("filter: unexpected end of expression")
+	}
+	return fmt.Errorf("filter: unexpected %q at position %d", t.text, t.pos)
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(tokenOperator, "||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(tokenOperator, "&&") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.accept(tokenOperator, "!") {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{operand: operand}, nil
+	}
+	if p.accept(tokenOperator, "(") {
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokenOperator, ")"); err != nil {
+			return nil, err
+		}
+		return n, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (node, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.peek()
+	if t.kind == tokenKeyword && t.text == "in" {
+		p.next()
+		list, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+		return &inNode{operand: left, list: list}, nil
+	}
+	if t.kind != tokenOperator {
+		return &truthNode{operand: left}, nil
+	}
+
+	switch t.text {
+	case "==", "!=", "<", "<=", ">", ">=":
+		p.next()
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return &compareNode{op: t.text, left: left, right: right}, nil
+	case "=~", "!~":
+		p.next()
+		pattern := p.next()
+		if pattern.kind != tokenString {
+			return nil, fmt.Errorf("filter: %s expects a string pattern at position %d", t.text, pattern.pos)
+		}
+		re, err := regexp.Compile(pattern.text)
+		if err != nil {
+			return nil, fmt.Errorf("filter: invalid pattern at position %d: %v", pattern.pos, err)
+		}
+		return &matchNode{negate: t.text == "!~", operand: left, re: re}, nil
+	}
+	return &truthNode{operand: left}, nil
+}
+
+func (p *parser) parseOperand() (operand, error) {
+	t := p.peek()
+	if t.kind == tokenPath {
+		p.next()
+		return pathOperand(t.text), nil
+	}
+	v, err := p.parseLiteral()
+	if err != nil {
+		return nil, err
+	}
+	return literalOperand(v), nil
+}
+
+func (p *parser) parseLiteral() (value, error) {
+	t := p.peek()
+	switch t.kind {
+	case tokenString:
+		p.next()
+		return value{kind: kindString, str: t.text}, nil
+	case tokenNumber:
+		p.next()
+		f, _ := strconv.ParseFloat(t.text, 64)
+		return value{kind: kindNumber, num: f, str: t.text}, nil
+	case tokenKeyword:
+		switch t.text {
+		case "true", "false":
+			p.next()
+			return value{kind: kindBool, b: t.text == "true", str: t.text}, nil
+		case "null":
+			p.next()
+			return value{kind: kindNull}, nil
+		}
+	}
+	return value{}, p.unexpected()
+}
+
+func (p *parser) parseList() ([]value, error) {
+	if err := p.expect(tokenOperator, "["); err != nil {
+		return nil, err
+	}
+	list := []value{}
+	if p.accept(tokenOperator, "]") {
+		return list, nil
+	}
+	for {
+		v, err := p.parseLiteral()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+		if p.accept(tokenOperator, "]") {
+			return list, nil
+		}
+		if err := p.expect(tokenOperator, ","); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/mudkipme/timburr/metrics"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
 )
@@ -21,6 +22,7 @@ type MetadataWatcher struct {
 	consumer      *kafka.Consumer
 	stopChan      chan bool
 	eventChannels []chan MetadataWatcherEvent
+	lastErr       error
 }
 
 // NewMetadataWatcher creates a new metadata watcher with a kafka consumer
@@ -54,6 +56,10 @@ func (mw *MetadataWatcher) setup(refreshInterval time.Duration) (chan bool, erro
 			case <-ticker.C:
 				topics, err := mw.GetTopics()
 				added := false
+				metrics.MetadataRefreshes.WithLabelValues(metrics.Outcome(err)).Inc()
+				mw.mutex.Lock()
+				mw.lastErr = err
+				mw.mutex.Unlock()
 				if err != nil {
 					log.WithError(err).Warn("get topic error")
 					mw.emit(nil, err)
@@ -118,6 +124,13 @@ func (mw *MetadataWatcher) RemoveListener(ch chan MetadataWatcherEvent) {
 	}
 }
 
+// LastError returns the error of the last refresh, or nil if it succeeded
+func (mw *MetadataWatcher) LastError() error {
+	mw.mutex.RLock()
+	defer mw.mutex.RUnlock()
+	return mw.lastErr
+}
+
 // GetTopics lists all topics from kafka
 func (mw *MetadataWatcher) GetTopics() ([]string, error) {
 	metadata, err := mw.consumer.GetMetadata(nil, true, 5000)
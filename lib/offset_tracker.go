@@ -0,0 +1,97 @@
+package lib
+
+import (
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+)
+
+type partitionKey struct {
+	topic     string
+	partition int32
+}
+
+type trackedOffset struct {
+	offset kafka.Offset
+	done   bool
+	failed bool
+}
+
+// offsetTracker tracks the messages being handled in each partition, to find the low-water mark which is safe to commit
+type offsetTracker struct {
+	partitions map[partitionKey][]*trackedOffset
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{
+		partitions: make(map[partitionKey][]*trackedOffset),
+	}
+}
+
+// add starts tracking a message, messages of a partition must be added in the order of offsets
+func (t *offsetTracker) add(tp kafka.TopicPartition) {
+	key := partitionKey{topic: *tp.Topic, partition: tp.Partition}
+	t.partitions[key] = append(t.partitions[key], &trackedOffset{offset: tp.Offset})
+}
+
+// done marks a message as handled, and returns the next offset to commit if the low-water mark advances
+func (t *offsetTracker) done(tp kafka.TopicPartition) (kafka.TopicPartition, bool) {
+	key := partitionKey{topic: *tp.Topic, partition: tp.Partition}
+	offsets := t.partitions[key]
+	for _, o := range offsets {
+		if o.offset == tp.Offset {
+			o.done = true
+			break
+		}
+	}
+
+	advanced := false
+	for len(offsets) > 0 && offsets[0].done {
+		tp.Offset = offsets[0].offset + 1
+		offsets = offsets[1:]
+		advanced = true
+	}
+	if len(offsets) == 0 {
+		delete(t.partitions, key)
+	} else {
+		t.partitions[key] = offsets
+	}
+	return tp, advanced
+}
+
+// fail marks a message as failed to handle, it's kept uncommitted until it's done
+func (t *offsetTracker) fail(tp kafka.TopicPartition) {
+	for _, o := range t.partitions[partitionKey{topic: *tp.Topic, partition: tp.Partition}] {
+		if o.offset == tp.Offset {
+			o.failed = true
+			return
+		}
+	}
+}
+
+// hasFailed reports whether any tracked message failed to handle
+func (t *offsetTracker) hasFailed() bool {
+	for _, offsets := range t.partitions {
+		for _, o := range offsets {
+			if o.failed && !o.done {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// remove stops tracking the partitions, e.g. when they are revoked
+func (t *offsetTracker) remove(partitions []kafka.TopicPartition) {
+	for _, tp := range partitions {
+		delete(t.partitions, partitionKey{topic: *tp.Topic, partition: tp.Partition})
+	}
+}
+
+// unhandled returns each tracked partition with its lowest offset not yet handled
+func (t *offsetTracker) unhandled() []kafka.TopicPartition {
+	partitions := []kafka.TopicPartition{}
+	for key, offsets := range t.partitions {
+		topic := key.topic
+		partitions = append(partitions, kafka.TopicPartition{Topic: &topic, Partition: key.partition, Offset: offsets[0].offset})
+	}
+	return partitions
+}
@@ -0,0 +1,123 @@
+package lib
+
+import (
+	"testing"
+
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+)
+
+func topicPartition(topic string, partition int32, offset kafka.Offset) kafka.TopicPartition {
+	return kafka.TopicPartition{Topic: &topic, Partition: partition, Offset: offset}
+}
+
+func TestOffsetTrackerDone(t *testing.T) {
+	type step struct {
+		offset   kafka.Offset
+		want     kafka.Offset
+		advanced bool
+	}
+	tests := []struct {
+		name  string
+		added []kafka.Offset
+		steps []step
+	}{
+		{
+			name:  "in order",
+			added: []kafka.Offset{10, 11, 12},
+			steps: []step{{10, 11, true}, {11, 12, true}, {12, 13, true}},
+		},
+		{
+			name:  "out of order",
+			added: []kafka.Offset{10, 11, 12, 13},
+			steps: []step{{12, 0, false}, {11, 0, false}, {10, 13, true}, {13, 14, true}},
+		},
+		{
+			name:  "gaps between offsets",
+			added: []kafka.Offset{5, 8, 20},
+			steps: []step{{8, 0, false}, {5, 9, true}, {20, 21, true}},
+		},
+		{
+			name:  "unknown offset",
+			added: []kafka.Offset{5, 6},
+			steps: []step{{7, 0, false}, {5, 6, true}, {6, 7, true}},
+		},
+	}
+	for _, tt := range tests {
+		tracker := newOffsetTracker()
+		for _, o := range tt.added {
+			tracker.add(topicPartition("jobs", 0, o))
+		}
+		for _, s := range tt.steps {
+			tp, advanced := tracker.done(topicPartition("jobs", 0, s.offset))
+			if advanced != s.advanced || (advanced && tp.Offset != s.want) {
+				t.Errorf("%v: done(%v) = %v, %v, want %v, %v", tt.name, s.offset, tp.Offset, advanced, s.want, s.advanced)
+			}
+		}
+		if len(tracker.partitions) != 0 {
+			t.Errorf("%v: partitions still tracked after all messages are done", tt.name)
+		}
+	}
+}
+
+func TestOffsetTrackerPartitions(t *testing.T) {
+	tracker := newOffsetTracker()
+	tracker.add(topicPartition("jobs", 0, 1))
+	tracker.add(topicPartition("jobs", 1, 1))
+	tracker.add(topicPartition("purges", 0, 1))
+	tracker.add(topicPartition("jobs", 0, 2))
+
+	// partitions are tracked separately
+	if tp, advanced := tracker.done(topicPartition("jobs", 0, 2)); advanced {
+		t.Errorf("jobs [0] advanced to %v before offset 1 is done", tp.Offset)
+	}
+	if tp, advanced := tracker.done(topicPartition("jobs", 1, 1)); !advanced || tp.Offset != 2 || tp.Partition != 1 {
+		t.Errorf("jobs [1] = %v, %v, want offset 2", tp, advanced)
+	}
+	if tp, advanced := tracker.done(topicPartition("purges", 0, 1)); !advanced || tp.Offset != 2 || *tp.Topic != "purges" {
+		t.Errorf("purges [0] = %v, %v, want offset 2", tp, advanced)
+	}
+}
+
+func TestOffsetTrackerRemove(t *testing.T) {
+	tracker := newOffsetTracker()
+	tracker.add(topicPartition("jobs", 0, 1))
+	tracker.add(topicPartition("jobs", 0, 2))
+	tracker.add(topicPartition("jobs", 1, 1))
+
+	// a revoked partition is forgotten, messages done later don't advance it
+	tracker.remove([]kafka.TopicPartition{topicPartition("jobs", 0, kafka.OffsetInvalid)})
+	if tp, advanced := tracker.done(topicPartition("jobs", 0, 2)); advanced {
+		t.Errorf("revoked partition advanced to %v", tp.Offset)
+	}
+	if tp, advanced := tracker.done(topicPartition("jobs", 0, 1)); advanced {
+		t.Errorf("revoked partition advanced to %v", tp.Offset)
+	}
+
+	// the partition is tracked from scratch when it's assigned again
+	tracker.add(topicPartition("jobs", 0, 1))
+	tracker.add(topicPartition("jobs", 0, 2))
+	if tp, advanced := tracker.done(topicPartition("jobs", 0, 1)); !advanced || tp.Offset != 2 {
+		t.Errorf("reassigned partition = %v, %v, want offset 2", tp.Offset, advanced)
+	}
+
+	// other partitions are kept
+	if tp, advanced := tracker.done(topicPartition("jobs", 1, 1)); !advanced || tp.Offset != 2 {
+		t.Errorf("jobs [1] = %v, %v, want offset 2", tp.Offset, advanced)
+	}
+}
+
+func TestOffsetTrackerUnhandled(t *testing.T) {
+	tracker := newOffsetTracker()
+	for _, o := range []kafka.Offset{1, 2, 3} {
+		tracker.add(topicPartition("jobs", 0, o))
+	}
+	tracker.add(topicPartition("jobs", 1, 7))
+	tracker.done(topicPartition("jobs", 0, 1))
+	tracker.done(topicPartition("jobs", 0, 3))
+	tracker.done(topicPartition("jobs", 1, 7))
+
+	unhandled := tracker.unhandled()
+	if len(unhandled) != 1 || unhandled[0].Partition != 0 || unhandled[0].Offset != 2 {
+		t.Errorf("unhandled() = %v, want jobs [0] at offset 2", unhandled)
+	}
+}
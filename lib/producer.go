@@ -0,0 +1,18 @@
+package lib
+
+import (
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+)
+
+// taskProducer lets executors produce messages with the producer of the server
+type taskProducer struct {
+	producer *kafka.Producer
+}
+
+func (p *taskProducer) Produce(topic string, key []byte, value []byte) error {
+	return produceMessage(p.producer, &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+		Key:            key,
+		Value:          value,
+	})
+}
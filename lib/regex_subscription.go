@@ -2,9 +2,11 @@ package lib
 
 import (
 	"errors"
+	"fmt"
 	"sync"
 	"time"
 
+	"github.com/mudkipme/timburr/lib/task"
 	"github.com/mudkipme/timburr/utils"
 )
 
@@ -17,6 +19,7 @@ type RegexSubscription struct {
 	stopCh          chan bool
 	subscribed      bool
 	subscription    *BasicSubscription
+	paused          bool
 	mutex           sync.Mutex
 }
 
@@ -31,6 +34,9 @@ func (sub *RegexSubscription) Subscribe() error {
 	if sub.MetadataWatcher == nil {
 		return errors.New("metadata watcher not exists")
 	}
+	if err := validateRule(sub.rule); err != nil {
+		return err
+	}
 	topics, err := sub.MetadataWatcher.GetTopics()
 	if err != nil {
 		return err
@@ -79,19 +85,103 @@ func (sub *RegexSubscription) resubscribe(topics []string) error {
 		return nil
 	}
 
-	newRule := utils.RuleConfig{
-		Name:        sub.rule.Name,
-		Topics:      topics,
-		Filter:      sub.rule.Filter,
-		TaskType:    sub.rule.TaskType,
-	}
+	newRule := sub.rule
+	newRule.Topic = ""
+	newRule.Topics = topics
+	newRule.ExcludeTopics = nil
 	sub.subscription = &BasicSubscription{
 		config: sub.config,
 		rule:   newRule,
+		paused: sub.paused,
 	}
 	return sub.subscription.Subscribe()
 }
 
+// Alive returns an error if the underlay basic subscription is stuck
+func (sub *RegexSubscription) Alive() error {
+	sub.mutex.Lock()
+	subscription := sub.subscription
+	sub.mutex.Unlock()
+	if subscription == nil {
+		return nil
+	}
+	return subscription.Alive()
+}
+
+// Ready returns an error if the underlay basic subscription is not consuming messages
+func (sub *RegexSubscription) Ready() error {
+	sub.mutex.Lock()
+	subscribed, subscription := sub.subscribed, sub.subscription
+	sub.mutex.Unlock()
+	if !subscribed {
+		return fmt.Errorf("rule %v is not subscribed", sub.rule.Name)
+	}
+	if subscription == nil {
+		return fmt.Errorf("rule %v has no matching topic", sub.rule.Name)
+	}
+	return subscription.Ready()
+}
+
+// Status returns the runtime status of the rule
+func (sub *RegexSubscription) Status() RuleStatus {
+	sub.mutex.Lock()
+	subscribed, subscription, paused := sub.subscribed, sub.subscription, sub.paused
+	sub.mutex.Unlock()
+	if subscription != nil {
+		return subscription.Status()
+	}
+	return RuleStatus{
+		Name:       sub.rule.Name,
+		TaskType:   task.NormalizeType(sub.rule.TaskType),
+		Topics:     []string{},
+		Subscribed: subscribed,
+		Paused:     paused,
+		Partitions: []PartitionStatus{},
+	}
+}
+
+// Pause stops consuming messages, including the subscriptions after topics change
+func (sub *RegexSubscription) Pause() error {
+	return sub.setPaused(true)
+}
+
+// Resume continues consuming messages
+func (sub *RegexSubscription) Resume() error {
+	return sub.setPaused(false)
+}
+
+func (sub *RegexSubscription) setPaused(paused bool) error {
+	sub.mutex.Lock()
+	sub.paused = paused
+	subscription := sub.subscription
+	sub.mutex.Unlock()
+	if subscription == nil {
+		return nil
+	}
+	return subscription.setPaused(paused)
+}
+
+// ResetOffsets commits new offsets for the partitions assigned to the underlay basic subscription
+func (sub *RegexSubscription) ResetOffsets(reset OffsetReset) error {
+	sub.mutex.Lock()
+	subscription := sub.subscription
+	sub.mutex.Unlock()
+	if subscription == nil {
+		return fmt.Errorf("rule %v has no matching topic", sub.rule.Name)
+	}
+	return subscription.ResetOffsets(reset)
+}
+
+func (sub *RegexSubscription) resetExecutor() error {
+	sub.mutex.Lock()
+	subscription := sub.subscription
+	sub.mutex.Unlock()
+	if subscription == nil {
+		return nil
+	}
+	return subscription.resetExecutor()
+}
+
 // Unsubscribe stops the underlay basic subscription and metadata watcher
 func (sub *RegexSubscription) Unsubscribe() {
 	sub.mutex.Lock()
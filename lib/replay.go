@@ -0,0 +1,256 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	rate "github.com/beefsack/go-rate"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+)
+
+// ReplayConfig defines which messages to replay and how
+type ReplayConfig struct {
+	BrokerList string
+	GroupID    string
+	Producer   *kafka.Producer
+	// Topic is the topic to read messages from, usually a dead-letter topic
+	Topic string
+	// Partition limits the replay to a single partition, -1 means all partitions
+	Partition int32
+	// FromOffset and ToOffset are the inclusive offset range, -1 means unbounded
+	FromOffset int64
+	ToOffset   int64
+	// Since and Until are the time range of messages, zero means unbounded
+	Since time.Time
+	Until time.Time
+	// Rule only replays dead-lettered messages of this rule when it's not empty
+	Rule string
+	// TargetTopic overrides the topic messages are produced to
+	TargetTopic  string
+	DryRun       bool
+	RateLimit    int
+	RateInterval time.Duration
+}
+
+// ReplayResult counts the messages handled in a replay
+type ReplayResult struct {
+	Replayed int
+	Skipped  int
+	Failed   int
+}
+
+type replayRange struct {
+	start kafka.Offset
+	end   kafka.Offset
+}
+
+// Replay reads messages in a range of a topic and produces them to their original topics
+func Replay(config *ReplayConfig) (*ReplayResult, error) {
+	if config.Topic == "" {
+		return nil, errors.New("replay topic is required")
+	}
+	if config.Producer == nil && !config.DryRun {
+		return nil, errors.New("producer is required")
+	}
+
+	consumer, err := kafka.NewConsumer(&kafka.ConfigMap{
+		"bootstrap.servers":    config.BrokerList,
+		"group.id":             config.GroupID,
+		"enable.auto.commit":   false,
+		"enable.partition.eof": true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer consumer.Close()
+
+	ranges, err := replayRanges(consumer, config)
+	if err != nil {
+		return nil, err
+	}
+	assignment := []kafka.TopicPartition{}
+	for partition, r := range ranges {
+		if r.start >= r.end {
+			delete(ranges, partition)
+			continue
+		}
+		assignment = append(assignment, kafka.TopicPartition{Topic: &config.Topic, Partition: partition, Offset: r.start})
+	}
+	result := &ReplayResult{}
+	if len(assignment) == 0 {
+		return result, nil
+	}
+	if err = consumer.Assign(assignment); err != nil {
+		return nil, err
+	}
+
+	var limiter *rate.RateLimiter
+	if config.RateLimit > 0 {
+		if config.RateInterval == 0 {
+			config.RateInterval = time.Second
+		}
+		limiter = rate.New(config.RateLimit, config.RateInterval)
+	}
+
+	for len(ranges) > 0 {
+		ev := consumer.Poll(100)
+		if ev == nil {
+			continue
+		}
+		switch e := ev.(type) {
+		case *kafka.Message:
+			partition := e.TopicPartition.Partition
+			r, ok := ranges[partition]
+			if !ok {
+				continue
+			}
+			if e.TopicPartition.Offset >= r.end {
+				delete(ranges, partition)
+				continue
+			}
+			if e.TopicPartition.Offset == r.end-1 {
+				delete(ranges, partition)
+			}
+			if !replayWanted(e, config) {
+				result.Skipped++
+				continue
+			}
+			if limiter != nil {
+				limiter.Wait()
+			}
+			if err := replayMessage(e, config); err != nil {
+				log.WithError(err).WithField("offset", e.TopicPartition.Offset).Warn("replay message failed")
+				result.Failed++
+				continue
+			}
+			result.Replayed++
+		case kafka.PartitionEOF:
+			delete(ranges, e.Partition)
+		case kafka.Error:
+			if e.Code() == kafka.ErrAllBrokersDown {
+				return result, e
+			}
+			log.WithError(e).Warn("consume message error")
+		}
+	}
+	return result, nil
+}
+
+// replayRanges resolves the offset range of each partition, the end offset is exclusive
+func replayRanges(consumer *kafka.Consumer, config *ReplayConfig) (map[int32]*replayRange, error) {
+	metadata, err := consumer.GetMetadata(&config.Topic, false, 5000)
+	if err != nil {
+		return nil, err
+	}
+	topic, ok := metadata.Topics[config.Topic]
+	if !ok || topic.Error.Code() != kafka.ErrNoError {
+		return nil, fmt.Errorf("topic %v not found", config.Topic)
+	}
+
+	ranges := make(map[int32]*replayRange)
+	for _, p := range topic.Partitions {
+		if config.Partition >= 0 && p.ID != config.Partition {
+			continue
+		}
+		low, high, err := consumer.QueryWatermarkOffsets(config.Topic, p.ID, 5000)
+		if err != nil {
+			return nil, err
+		}
+		// the high watermark is taken before replaying, so messages replayed into the same topic are not read again
+		r := &replayRange{start: kafka.Offset(low), end: kafka.Offset(high)}
+		if config.FromOffset >= 0 && kafka.Offset(config.FromOffset) > r.start {
+			r.start = kafka.Offset(config.FromOffset)
+		}
+		if config.ToOffset >= 0 && kafka.Offset(config.ToOffset+1) < r.end {
+			r.end = kafka.Offset(config.ToOffset + 1)
+		}
+		if !config.Since.IsZero() {
+			offset, err := offsetForTime(consumer, config.Topic, p.ID, config.Since)
+			if err != nil {
+				return nil, err
+			}
+			if offset < 0 {
+				offset = kafka.Offset(high)
+			}
+			if offset > r.start {
+				r.start = offset
+			}
+		}
+		if !config.Until.IsZero() {
+			offset, err := offsetForTime(consumer, config.Topic, p.ID, config.Until)
+			if err != nil {
+				return nil, err
+			}
+			if offset >= 0 && offset < r.end {
+				r.end = offset
+			}
+		}
+		ranges[p.ID] = r
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("no partition found in topic %v", config.Topic)
+	}
+	return ranges, nil
+}
+
+// offsetForTime returns the earliest offset whose timestamp is equal or later than t, or -1 if there is none
+func offsetForTime(consumer *kafka.Consumer, topic string, partition int32, t time.Time) (kafka.Offset, error) {
+	offsets, err := consumer.OffsetsForTimes([]kafka.TopicPartition{{
+		Topic:     &topic,
+		Partition: partition,
+		Offset:    kafka.Offset(t.UnixNano() / int64(time.Millisecond)),
+	}}, 5000)
+	if err != nil {
+		return 0, err
+	}
+	if len(offsets) == 0 || offsets[0].Offset < 0 {
+		return -1, nil
+	}
+	return offsets[0].Offset, nil
+}
+
+func replayWanted(km *kafka.Message, config *ReplayConfig) bool {
+	if config.Rule == "" {
+		return true
+	}
+	rule, _ := headerValue(km, HeaderRule)
+	return rule == config.Rule
+}
+
+func replayMessage(km *kafka.Message, config *ReplayConfig) error {
+	topic := config.TargetTopic
+	if topic == "" {
+		topic, _ = headerValue(km, HeaderOriginalTopic)
+	}
+	if topic == "" {
+		topic = *km.TopicPartition.Topic
+	}
+
+	logger := log.WithField("topic", topic).WithField("offset", km.TopicPartition.Offset).WithField("partition", km.TopicPartition.Partition)
+	if config.DryRun {
+		logger.Info("replay message (dry run)")
+		return nil
+	}
+
+	// dead-letter headers are dropped, so they won't pile up if the message fails again
+	headers := []kafka.Header{}
+	for _, h := range km.Headers {
+		if !strings.HasPrefix(h.Key, "timburr-") {
+			headers = append(headers, h)
+		}
+	}
+	err := produceMessage(config.Producer, &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+		Key:            km.Key,
+		Value:          km.Value,
+		Headers:        headers,
+	})
+	if err != nil {
+		return err
+	}
+	logger.Info("message replayed")
+	return nil
+}
@@ -1,10 +1,14 @@
 package lib
 
 import (
+	"fmt"
+	"reflect"
 	"sync"
 	"time"
 
+	"github.com/mudkipme/timburr/lib/task"
 	"github.com/mudkipme/timburr/utils"
+	log "github.com/sirupsen/logrus"
 	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
 )
 
@@ -13,6 +17,7 @@ type Subscriber struct {
 	metadataWatcher *MetadataWatcher
 	config          *SubScriberConfig
 	subscriptions   []Subscription
+	rules           []utils.RuleConfig
 	mutex           sync.Mutex
 }
 
@@ -22,15 +27,23 @@ type SubScriberConfig struct {
 	GroupIDPrefix                string
 	MetadataWatchGroupID         string
 	MetadataWatchRefreshInterval time.Duration
+	Producer                     *kafka.Producer
+	LivenessTimeout              time.Duration
 }
 
-// DefaultSubscriber creates a subscriber based on config.yml
-func DefaultSubscriber() *Subscriber {
+// DefaultSubscriber creates a subscriber based on config.yml, the producer is used to send dead-letter messages and by produce executors
+func DefaultSubscriber(producer *kafka.Producer) *Subscriber {
+	config := utils.CurrentConfig()
 	cfg := SubScriberConfig{
-		BrokerList:                   utils.Config.Kafka.BrokerList,
-		GroupIDPrefix:                utils.Config.Options.GroupIDPrefix,
-		MetadataWatchGroupID:         utils.Config.Options.MetadataWatchGroupID,
-		MetadataWatchRefreshInterval: time.Millisecond * time.Duration(utils.Config.Options.MetadataWatchRefreshInterval),
+		BrokerList:                   config.Kafka.BrokerList,
+		GroupIDPrefix:                config.Options.GroupIDPrefix,
+		MetadataWatchGroupID:         config.Options.MetadataWatchGroupID,
+		MetadataWatchRefreshInterval: time.Millisecond * time.Duration(config.Options.MetadataWatchRefreshInterval),
+		Producer:                     producer,
+		LivenessTimeout:              time.Millisecond * time.Duration(config.Options.LivenessTimeout),
+	}
+	if cfg.LivenessTimeout == 0 {
+		cfg.LivenessTimeout = 15 * time.Minute
 	}
 	return NewSubscriber(&cfg)
 }
@@ -41,6 +54,9 @@ func NewSubscriber(config *SubScriberConfig) *Subscriber {
 		config:        config,
 		subscriptions: []Subscription{},
 	}
+	if config.Producer != nil {
+		task.SetProducer(&taskProducer{producer: config.Producer})
+	}
 	return s
 }
 
@@ -48,12 +64,16 @@ func NewSubscriber(config *SubScriberConfig) *Subscriber {
 func (s *Subscriber) Subscribe(rule utils.RuleConfig) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	return s.subscribe(rule)
+}
 
+func (s *Subscriber) subscribe(rule utils.RuleConfig) error {
 	sub := NewSubscription(&SubscriptionConfig{
-		BrokerList:    s.config.BrokerList,
-		GroupIDPrefix: s.config.GroupIDPrefix,
+		BrokerList:      s.config.BrokerList,
+		GroupIDPrefix:   s.config.GroupIDPrefix,
+		Producer:        s.config.Producer,
+		LivenessTimeout: s.config.LivenessTimeout,
 	}, rule)
-	s.subscriptions = append(s.subscriptions, sub)
 
 	// create a metadata watcher
 	if sub, ok := sub.(*RegexSubscription); ok {
@@ -74,7 +94,114 @@ func (s *Subscriber) Subscribe(rule utils.RuleConfig) error {
 		sub.MetadataWatcher = s.metadataWatcher
 	}
 
-	return sub.Subscribe()
+	// a rule failed to subscribe is not kept, so it's subscribed again in the next reload
+	if err := sub.Subscribe(); err != nil {
+		return err
+	}
+	s.subscriptions = append(s.subscriptions, sub)
+	s.rules = append(s.rules, rule)
+	return nil
+}
+
+// Reload compares rules with the current subscriptions, subscribes added rules, unsubscribes removed rules and restarts changed rules,
+// a changed rule with an invalid filter or task keeps running with the previous rule
+func (s *Subscriber) Reload(rules []utils.RuleConfig) error {
+	s.mutex.Lock()
+	current := append([]Subscription{}, s.subscriptions...)
+	currentRules := append([]utils.RuleConfig{}, s.rules...)
+	s.mutex.Unlock()
+
+	wanted := make(map[string]utils.RuleConfig)
+	for _, rule := range rules {
+		wanted[rule.Name] = rule
+	}
+
+	var err error
+	kept := make(map[string]bool)
+	stale := make(map[Subscription]bool)
+	for i, sub := range current {
+		rule := currentRules[i]
+		newRule, ok := wanted[rule.Name]
+		if ok && reflect.DeepEqual(rule, newRule) {
+			// executors are created again, as their default configuration may change
+			if err := sub.resetExecutor(); err != nil {
+				log.WithError(err).Errorf("reset executor of rule %v failed", rule.Name)
+			}
+			kept[rule.Name] = true
+			continue
+		}
+		if ok {
+			if e := validateRule(newRule); e != nil {
+				log.WithError(e).Errorf("rule %v is invalid, the previous rule keeps running", rule.Name)
+				kept[rule.Name] = true
+				err = e
+				continue
+			}
+		}
+		stale[sub] = true
+	}
+
+	// subscriptions are stopped without holding the mutex, as it waits for messages being handled
+	s.mutex.Lock()
+	subscriptions := []Subscription{}
+	keptRules := []utils.RuleConfig{}
+	for i, sub := range s.subscriptions {
+		if !stale[sub] {
+			subscriptions = append(subscriptions, sub)
+			keptRules = append(keptRules, s.rules[i])
+		}
+	}
+	s.subscriptions = subscriptions
+	s.rules = keptRules
+	s.mutex.Unlock()
+	for i, sub := range current {
+		if stale[sub] {
+			sub.Unsubscribe()
+			log.Infof("unsubscribed rule: %v", currentRules[i].Name)
+		}
+	}
+
+	for _, rule := range rules {
+		if kept[rule.Name] {
+			continue
+		}
+		if e := s.Subscribe(rule); e != nil {
+			log.WithError(e).Errorf("subscribe rule %v failed", rule.Name)
+			err = e
+		}
+	}
+	return err
+}
+
+// Alive returns an error if any subscription is stuck
+func (s *Subscriber) Alive() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, sub := range s.subscriptions {
+		if err := sub.Alive(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Ready returns an error if any subscription is not consuming messages, or the metadata watcher failed to refresh topics
+func (s *Subscriber) Ready() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.metadataWatcher != nil {
+		if err := s.metadataWatcher.LastError(); err != nil {
+			return fmt.Errorf("metadata watcher refresh failed: %v", err)
+		}
+	}
+	for _, sub := range s.subscriptions {
+		if err := sub.Ready(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Unsubscribe turns off all subscriptions
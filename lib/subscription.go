@@ -1,19 +1,36 @@
 package lib
 
 import (
+	"fmt"
+	"time"
+
+	"github.com/mudkipme/timburr/lib/filter"
+	"github.com/mudkipme/timburr/lib/task"
 	"github.com/mudkipme/timburr/utils"
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
 )
 
 // SubscriptionConfig is the configuration for all subscriptions
 type SubscriptionConfig struct {
-	BrokerList    string
-	GroupIDPrefix string
+	BrokerList      string
+	GroupIDPrefix   string
+	Producer        *kafka.Producer
+	LivenessTimeout time.Duration
 }
 
 // Subscription contains basic subscription and regex subscription
 type Subscription interface {
 	Subscribe() error
 	Unsubscribe()
+	// Alive returns an error if the subscription is stuck
+	Alive() error
+	// Ready returns an error if the subscription is not consuming messages
+	Ready() error
+	Status() RuleStatus
+	Pause() error
+	Resume() error
+	ResetOffsets(reset OffsetReset) error
+	resetExecutor() error
 }
 
 // NewSubscription creates a new subscription with configuration and rule
@@ -32,3 +49,69 @@ func NewSubscription(config *SubscriptionConfig, rule utils.RuleConfig) Subscrip
 	}
 	return s
 }
+
+func compileFilter(rule utils.RuleConfig) (*filter.Filter, error) {
+	if rule.Filter == "" {
+		return nil, nil
+	}
+	f, err := filter.Compile(rule.Filter)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter in rule %v: %v", rule.Name, err)
+	}
+	return f, nil
+}
+
+// validateRule builds the filter and executor of a rule, to find errors before subscribing it
+func validateRule(rule utils.RuleConfig) error {
+	if _, err := compileFilter(rule); err != nil {
+		return err
+	}
+	_, err := newExecutor(rule)
+	return err
+}
+
+func newExecutor(rule utils.RuleConfig) (task.Executor, error) {
+	if err := checkReboundRule(rule); err != nil {
+		return nil, err
+	}
+	var executor task.Executor
+	var err error
+	if tenants := utils.CurrentConfig().Tenants; len(tenants) > 0 && !rule.IgnoreTenants {
+		executor, err = task.NewTenantExecutor(rule.TaskType, tenants, rule.TaskConfig)
+	} else {
+		executor, err = task.NewExecutor(rule.TaskType, rule.TaskConfig)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid task in rule %v: %v", rule.Name, err)
+	}
+	return executor, nil
+}
+
+// checkReboundRule rejects a purge rule consuming a rebound topic along with other topics,
+// since rebound purges wait until they are due and would hold up other messages of the rule
+func checkReboundRule(rule utils.RuleConfig) error {
+	if task.NormalizeType(rule.TaskType) != task.PurgeTask {
+		return nil
+	}
+	config := utils.CurrentConfig()
+	reboundTopics := []string{config.Purge.ReboundTopic}
+	for _, tenant := range config.Tenants {
+		if topic, ok := tenant.TaskConfig[task.PurgeTask]["reboundTopic"].(string); ok {
+			reboundTopics = append(reboundTopics, topic)
+		}
+	}
+	if topic, ok := rule.TaskConfig["reboundTopic"].(string); ok {
+		reboundTopics = append(reboundTopics, topic)
+	}
+
+	topics := ruleTopics(rule)
+	for _, reboundTopic := range reboundTopics {
+		if reboundTopic == "" || len(filterTopics(rule, []string{reboundTopic})) == 0 {
+			continue
+		}
+		if len(topics) != 1 || topics[0] != reboundTopic {
+			return fmt.Errorf("rule %v consumes the rebound topic %v with other topics, rebound purges need a dedicated rule", rule.Name, reboundTopic)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mudkipme/timburr/utils"
+)
+
+func TestSubscribeInvalidFilter(t *testing.T) {
+	rules := []utils.RuleConfig{
+		{Name: "basic", Topic: "mediawiki.job.refreshLinks", Filter: `type ==`},
+		{Name: "regex", Topic: "/^mediawiki\\.job\\./", Filter: `type =~ "("`},
+	}
+	for _, rule := range rules {
+		sub := NewSubscription(&SubscriptionConfig{}, rule)
+		if regex, ok := sub.(*RegexSubscription); ok {
+			regex.MetadataWatcher = &MetadataWatcher{}
+		}
+		err := sub.Subscribe()
+		if err == nil || !strings.Contains(err.Error(), "invalid filter in rule "+rule.Name) {
+			t.Errorf("Subscribe() of rule %v error %v, want invalid filter", rule.Name, err)
+		}
+		if err := sub.Ready(); err == nil {
+			t.Errorf("rule %v is ready after failing to subscribe", rule.Name)
+		}
+	}
+}
+
+func TestReloadInvalidRule(t *testing.T) {
+	s := NewSubscriber(&SubScriberConfig{BrokerList: "127.0.0.1:1"})
+	rule := utils.RuleConfig{Name: "purges", Topic: "cdn-url-purges", TaskType: "purge", Filter: `meta.uri =~ "^https://"`}
+	if err := s.Subscribe(rule); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Unsubscribe()
+
+	// a failed rule is not registered
+	if err := s.Subscribe(utils.RuleConfig{Name: "invalid", Topic: "cdn-url-purges", TaskType: "purge", Filter: `meta.uri ==`}); err == nil {
+		t.Error("Subscribe() of an invalid rule succeeded")
+	}
+	if len(s.subscriptions) != 1 || len(s.rules) != 1 {
+		t.Errorf("%v subscriptions registered, want 1", len(s.subscriptions))
+	}
+
+	// a changed rule with an invalid filter keeps the previous rule running
+	changed := rule
+	changed.Filter = `meta.uri =~ "("`
+	if err := s.Reload([]utils.RuleConfig{changed}); err == nil {
+		t.Error("Reload() with an invalid rule succeeded")
+	}
+	if len(s.subscriptions) != 1 || !s.subscriptions[0].Status().Subscribed || s.rules[0].Filter != rule.Filter {
+		t.Error("the previous rule is not kept running")
+	}
+
+	// a removed rule is unsubscribed
+	sub := s.subscriptions[0]
+	if err := s.Reload(nil); err != nil {
+		t.Error(err)
+	}
+	if len(s.subscriptions) != 0 || sub.Status().Subscribed {
+		t.Error("the removed rule is still subscribed")
+	}
+}
+
+func TestCheckReboundRule(t *testing.T) {
+	rebound := map[string]interface{}{"reboundTopic": "cdn-url-purges-rebound"}
+	tests := []struct {
+		rule  utils.RuleConfig
+		valid bool
+	}{
+		{utils.RuleConfig{Name: "rebound", Topic: "cdn-url-purges-rebound", TaskType: "purge", TaskConfig: rebound}, true},
+		{utils.RuleConfig{Name: "purge", Topic: "cdn-url-purges", TaskType: "purge", TaskConfig: rebound}, true},
+		{utils.RuleConfig{Name: "jobs", Topics: []string{"cdn-url-purges-rebound", "mediawiki.job.refreshLinks"}}, true},
+		{utils.RuleConfig{Name: "both", Topics: []string{"cdn-url-purges", "cdn-url-purges-rebound"}, TaskType: "purge", TaskConfig: rebound}, false},
+		{utils.RuleConfig{Name: "regex", Topic: "/^cdn-url-purges/", TaskType: "purge", TaskConfig: rebound}, false},
+		{utils.RuleConfig{Name: "excluded", Topic: "/^cdn-url-purges/", ExcludeTopics: []string{"cdn-url-purges-rebound"}, TaskType: "purge", TaskConfig: rebound}, true},
+	}
+	for _, tt := range tests {
+		err := checkReboundRule(tt.rule)
+		if (err == nil) != tt.valid {
+			t.Errorf("checkReboundRule() of rule %v error %v, want valid %v", tt.rule.Name, err, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package task
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/mudkipme/timburr/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// Cloudflare purge modes of purge entries
+const (
+	CFPurgeFiles    = "files"
+	CFPurgeTags     = "tags"
+	CFPurgePrefixes = "prefixes"
+)
+
+// cfBatchSize is the maximum number of files, tags or prefixes in a purge request
+const cfBatchSize = 30
+
+const cfMaxBackoff = time.Minute
+
+// cfCloseTimeout is how long pending items are retried when the batcher is closed
+const cfCloseTimeout = 10 * time.Second
+
+// cfModes are the order of modes to purge in a flush
+var cfModes = []string{CFPurgeFiles, CFPurgeTags, CFPurgePrefixes}
+
+// cfStatusError is returned when cloudflare responds 429 or 5xx, as cloudflare-go only tells the status in error messages
+type cfStatusError struct {
+	status int
+}
+
+func (e *cfStatusError) Error() string {
+	return fmt.Sprintf("cloudflare responded HTTP status %d", e.status)
+}
+
+// cfTransport returns cfStatusError for 429 and 5xx responses
+type cfTransport struct {
+	next http.RoundTripper
+}
+
+func (t *cfTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err == nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500) {
+		resp.Body.Close()
+		return nil, &cfStatusError{status: resp.StatusCode}
+	}
+	return resp, err
+}
+
+// cfRetryable reports whether a failed purge should be sent again, which is when cloudflare limits the rate,
+// responds 5xx or can't be reached, rather than rejecting the items
+func cfRetryable(err error) bool {
+	var statusErr *cfStatusError
+	var netErr net.Error
+	return errors.As(err, &statusErr) || errors.As(err, &netErr)
+}
+
+// newCFAPI creates a cloudflare client with an api token, 429 and 5xx responses are reported as cfStatusError
+func newCFAPI(token string, opts ...cloudflare.Option) (*cloudflare.API, error) {
+	client := &http.Client{Transport: &cfTransport{next: http.DefaultTransport}}
+	return cloudflare.NewWithAPIToken(token, append([]cloudflare.Option{cloudflare.HTTPClient(client)}, opts...)...)
+}
+
+// cfBatcher gathers cloudflare purges of many messages in a window and purges them in batches
+type cfBatcher struct {
+	api     *cloudflare.API
+	zoneID  string
+	window  time.Duration
+	mutex   sync.Mutex
+	pending map[string][]string
+	seen    map[string]bool
+	timer   *time.Timer
+	backoff time.Duration
+	// sendMutex makes sure only one flush sends requests at a time
+	sendMutex sync.Mutex
+}
+
+func newCFBatcher(api *cloudflare.API, zoneID string, window time.Duration) *cfBatcher {
+	return &cfBatcher{
+		api:     api,
+		zoneID:  zoneID,
+		window:  window,
+		pending: make(map[string][]string),
+		seen:    make(map[string]bool),
+	}
+}
+
+// add queues an item to purge by mode, and schedules a flush at the end of the window
+func (b *cfBatcher) add(mode string, item string) {
+	if mode == CFPurgePrefixes {
+		// prefixes don't contain the scheme
+		item = strings.TrimPrefix(strings.TrimPrefix(item, "https://"), "http://")
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	key := mode + " " + item
+	if b.seen[key] {
+		return
+	}
+	b.seen[key] = true
+	b.pending[mode] = append(b.pending[mode], item)
+	b.schedule(b.window)
+}
+
+func (b *cfBatcher) schedule(wait time.Duration) {
+	if b.timer == nil {
+		b.timer = time.AfterFunc(wait, b.flush)
+	}
+}
+
+// flush purges pending items, unsent items of all modes are queued again with backoff
+// if cloudflare limits the rate, fails or can't be reached
+func (b *cfBatcher) flush() {
+	b.sendMutex.Lock()
+	defer b.sendMutex.Unlock()
+
+	b.mutex.Lock()
+	pending := b.pending
+	b.pending = make(map[string][]string)
+	b.seen = make(map[string]bool)
+	b.timer = nil
+	b.mutex.Unlock()
+
+	for i, mode := range cfModes {
+		items := pending[mode]
+		for len(items) > 0 {
+			n := len(items)
+			if n > cfBatchSize {
+				n = cfBatchSize
+			}
+			err := b.purge(mode, items[:n])
+			if err != nil && cfRetryable(err) {
+				// the rate limit is of the whole zone, so other modes wait as well
+				unsent := map[string][]string{mode: items}
+				for _, m := range cfModes[i+1:] {
+					unsent[m] = pending[m]
+				}
+				b.retry(unsent, err)
+				return
+			}
+			logger := log.WithField("mode", mode).WithField("items", items[:n])
+			if err != nil {
+				logger.WithError(err).Warn("failed to purge cloudflare cache")
+			} else {
+				logger.Info("purge success")
+				b.mutex.Lock()
+				b.backoff = 0
+				b.mutex.Unlock()
+			}
+			outcome := purgeSucceeded
+			if err != nil {
+				outcome = purgeFailed
+			}
+			metrics.PurgeRequests.WithLabelValues("cloudflare", outcome.String()).Add(float64(n))
+			items = items[n:]
+		}
+	}
+}
+
+// retry queues items of each mode again and waits before the next flush, the wait is doubled each time
+func (b *cfBatcher) retry(unsent map[string][]string, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.backoff == 0 {
+		b.backoff = b.window
+	} else if b.backoff *= 2; b.backoff > cfMaxBackoff {
+		b.backoff = cfMaxBackoff
+	}
+	for mode, items := range unsent {
+		for _, item := range items {
+			key := mode + " " + item
+			if !b.seen[key] {
+				b.seen[key] = true
+				b.pending[mode] = append(b.pending[mode], item)
+			}
+		}
+	}
+	log.WithError(err).WithField("backoff", b.backoff.String()).Warn("cloudflare purge failed, retrying")
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.schedule(b.backoff)
+}
+
+// close sends pending items without waiting for the window, failed items are retried until the timeout,
+// items still unsent after that are logged as lost
+func (b *cfBatcher) close(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for {
+		b.mutex.Lock()
+		if b.timer != nil {
+			b.timer.Stop()
+			b.timer = nil
+		}
+		empty := len(b.pending) == 0
+		expired := !empty && time.Now().After(deadline)
+		if expired {
+			for mode, items := range b.pending {
+				log.WithField("mode", mode).WithField("items", items).Warn("cloudflare purges lost on close")
+			}
+		}
+		wait := b.backoff
+		b.mutex.Unlock()
+		if empty || expired {
+			return
+		}
+
+		// retries wait no longer than a second, since unsent items are lost after the timeout
+		if wait > time.Second {
+			wait = time.Second
+		}
+		if rest := time.Until(deadline); wait > rest {
+			wait = rest
+		}
+		time.Sleep(wait)
+		b.flush()
+	}
+}
+
+func (b *cfBatcher) purge(mode string, items []string) error {
+	switch mode {
+	case CFPurgeTags:
+		_, err := b.api.PurgeCache(b.zoneID, cloudflare.PurgeCacheRequest{Tags: items})
+		return err
+	case CFPurgePrefixes:
+		// cloudflare-go doesn't support purging by prefix yet
+		_, err := b.api.Raw("POST", "/zones/"+b.zoneID+"/purge_cache", map[string][]string{"prefixes": items})
+		return err
+	}
+	_, err := b.api.PurgeCache(b.zoneID, cloudflare.PurgeCacheRequest{Files: items})
+	return err
+}
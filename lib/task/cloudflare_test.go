@@ -0,0 +1,229 @@
+package task
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+)
+
+type cfRequest struct {
+	mode  string
+	items []string
+	at    time.Time
+}
+
+// cfServer records purge requests, and responds the statuses to the first requests
+type cfServer struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	requests []cfRequest
+	statuses []int
+}
+
+func newCFServer(t *testing.T, statuses ...int) *cfServer {
+	s := &cfServer{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/zones/zone-id/purge_cache" || r.Header.Get("Authorization") != "Bearer cf-token" {
+			t.Errorf("unexpected request %v %v", r.Method, r.URL)
+		}
+		var body map[string][]string
+		json.NewDecoder(r.Body).Decode(&body)
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		for mode, items := range body {
+			s.requests = append(s.requests, cfRequest{mode: mode, items: items, at: time.Now()})
+		}
+		if len(s.statuses) > 0 {
+			status := s.statuses[0]
+			s.statuses = s.statuses[1:]
+			w.WriteHeader(status)
+			w.Write([]byte(`{"success":false,"errors":[{"code":971,"message":"Please wait and consider throttling your request speed"}]}`))
+			return
+		}
+		w.Write([]byte(`{"success":true,"errors":[],"messages":[],"result":{"id":"zone-id"}}`))
+	}))
+	return s
+}
+
+// wait returns the requests once there are n of them
+func (s *cfServer) wait(t *testing.T, n int) []cfRequest {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		s.mutex.Lock()
+		requests := append([]cfRequest{}, s.requests...)
+		s.mutex.Unlock()
+		if len(requests) >= n {
+			return requests
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%v cloudflare requests received, want %v", len(s.requests), n)
+	return nil
+}
+
+func (s *cfServer) count() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.requests)
+}
+
+func newTestCFBatcher(t *testing.T, s *cfServer, window time.Duration) *cfBatcher {
+	api, err := newCFAPI("cf-token", cloudflare.UsingRetryPolicy(0, 0, 0), cloudflare.UsingRateLimit(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.BaseURL = s.URL
+	return newCFBatcher(api, "zone-id", window)
+}
+
+func TestCFBatcherBatches(t *testing.T) {
+	s := newCFServer(t)
+	defer s.Close()
+	b := newTestCFBatcher(t, s, 50*time.Millisecond)
+
+	for i := 0; i < 65; i++ {
+		b.add(CFPurgeFiles, "https://media.52poke.com/wiki/"+string(rune('A'+i%26))+string(rune('a'+i/26)))
+	}
+	b.add(CFPurgeTags, "page-1024")
+	b.add(CFPurgePrefixes, "https://media.52poke.com/wiki/thumb/")
+
+	requests := s.wait(t, 5)
+	sizes := []int{}
+	for _, r := range requests {
+		sizes = append(sizes, len(r.items))
+	}
+	want := []cfRequest{
+		{mode: "files"}, {mode: "files"}, {mode: "files"},
+		{mode: "tags", items: []string{"page-1024"}},
+		{mode: "prefixes", items: []string{"media.52poke.com/wiki/thumb/"}},
+	}
+	for i, w := range want {
+		if requests[i].mode != w.mode {
+			t.Errorf("request %v purges %v, want %v", i, requests[i].mode, w.mode)
+		}
+		if w.items != nil && (len(requests[i].items) != 1 || requests[i].items[0] != w.items[0]) {
+			t.Errorf("request %v purges %v, want %v", i, requests[i].items, w.items)
+		}
+	}
+	if sizes[0] != 30 || sizes[1] != 30 || sizes[2] != 5 {
+		t.Errorf("files are purged in batches of %v, want [30 30 5]", sizes[:3])
+	}
+}
+
+func TestCFBatcherWindow(t *testing.T) {
+	s := newCFServer(t)
+	defer s.Close()
+	b := newTestCFBatcher(t, s, 200*time.Millisecond)
+
+	start := time.Now()
+	b.add(CFPurgeFiles, "https://media.52poke.com/wiki/Pikachu.png")
+	time.Sleep(50 * time.Millisecond)
+	b.add(CFPurgeFiles, "https://media.52poke.com/wiki/Raichu.png")
+	b.add(CFPurgeFiles, "https://media.52poke.com/wiki/Pikachu.png")
+	if n := s.count(); n != 0 {
+		t.Fatalf("%v requests sent before the end of the window", n)
+	}
+
+	requests := s.wait(t, 1)
+	if elapsed := requests[0].at.Sub(start); elapsed < 200*time.Millisecond {
+		t.Errorf("flushed after %v, want the window of 200ms", elapsed)
+	}
+	if len(requests[0].items) != 2 {
+		t.Errorf("purged %v, want both files once", requests[0].items)
+	}
+
+	// a new window starts after the flush
+	b.add(CFPurgeFiles, "https://media.52poke.com/wiki/Pikachu.png")
+	requests = s.wait(t, 2)
+	if len(requests[1].items) != 1 {
+		t.Errorf("purged %v in the second window, want 1 file", requests[1].items)
+	}
+}
+
+func TestCFBatcherRateLimit(t *testing.T) {
+	s := newCFServer(t, http.StatusTooManyRequests, http.StatusTooManyRequests)
+	defer s.Close()
+	b := newTestCFBatcher(t, s, 50*time.Millisecond)
+
+	b.add(CFPurgeFiles, "https://media.52poke.com/wiki/Pikachu.png")
+	b.add(CFPurgeTags, "page-1024")
+
+	// the first two flushes are rate limited, the backoff is the window and then doubled
+	requests := s.wait(t, 4)
+	modes := []string{}
+	for _, r := range requests {
+		modes = append(modes, r.mode)
+	}
+	want := []string{"files", "files", "files", "tags"}
+	for i := range want {
+		if modes[i] != want[i] {
+			t.Fatalf("requests purge %v, want %v, tags must wait while the zone is rate limited", modes, want)
+		}
+	}
+	if wait := requests[1].at.Sub(requests[0].at); wait < 50*time.Millisecond {
+		t.Errorf("retried after %v, want 50ms", wait)
+	}
+	if wait := requests[2].at.Sub(requests[1].at); wait < 100*time.Millisecond {
+		t.Errorf("retried after %v, want 100ms", wait)
+	}
+
+	// the backoff is reset after a successful purge
+	b.mutex.Lock()
+	backoff := b.backoff
+	b.mutex.Unlock()
+	if backoff != 0 {
+		t.Errorf("backoff is %v after a successful purge, want 0", backoff)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := s.count(); n != 4 {
+		t.Errorf("%v requests sent, want 4", n)
+	}
+}
+
+func TestCFBatcherFailures(t *testing.T) {
+	// a server error is retried, while a rejected batch is dropped
+	s := newCFServer(t, http.StatusBadGateway, http.StatusBadRequest)
+	defer s.Close()
+	b := newTestCFBatcher(t, s, 50*time.Millisecond)
+
+	b.add(CFPurgeFiles, "https://media.52poke.com/wiki/Pikachu.png")
+	b.add(CFPurgeTags, "page-1024")
+	requests := s.wait(t, 3)
+	modes := []string{requests[0].mode, requests[1].mode, requests[2].mode}
+	if modes[0] != "files" || modes[1] != "files" || modes[2] != "tags" {
+		t.Errorf("requests purge %v, want [files files tags]", modes)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if n := s.count(); n != 3 {
+		t.Errorf("%v requests sent, want the rejected batch dropped", n)
+	}
+}
+
+func TestCFBatcherClose(t *testing.T) {
+	s := newCFServer(t, http.StatusServiceUnavailable)
+	defer s.Close()
+	b := newTestCFBatcher(t, s, time.Hour)
+
+	// pending items are sent without waiting for the window, and retried after a failure
+	b.add(CFPurgeFiles, "https://media.52poke.com/wiki/Pikachu.png")
+	b.close(5 * time.Second)
+	if n := s.count(); n != 2 {
+		t.Errorf("%v requests sent on close, want 2", n)
+	}
+
+	// items which can't be sent before the timeout are given up
+	s.mutex.Lock()
+	s.statuses = []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable}
+	s.mutex.Unlock()
+	b.add(CFPurgeFiles, "https://media.52poke.com/wiki/Raichu.png")
+	start := time.Now()
+	b.close(time.Second)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("close took %v, want the timeout of 1s", elapsed)
+	}
+}
@@ -0,0 +1,68 @@
+package task
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// dedupeCache remembers keys purged within a window, the oldest keys are evicted when it's full
+type dedupeCache struct {
+	window time.Duration
+	size   int
+	mutex  sync.Mutex
+	items  map[string]*list.Element
+	order  *list.List
+}
+
+type dedupeItem struct {
+	key    string
+	purged time.Time
+	// trailing is set when a purge of the key is deferred to the end of the window
+	trailing bool
+}
+
+func newDedupeCache(window time.Duration, size int) *dedupeCache {
+	return &dedupeCache{
+		window: window,
+		size:   size,
+		items:  make(map[string]*list.Element),
+		order:  list.New(),
+	}
+}
+
+// check reports whether a key has been purged in the window. The rest of the window is returned the first time
+// a key is checked again within its window, when a trailing purge should be sent, and zero afterwards
+func (c *dedupeCache) check(key string) (bool, time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return false, 0
+	}
+	item := e.Value.(*dedupeItem)
+	rest := c.window - time.Since(item.purged)
+	if rest <= 0 {
+		return false, 0
+	}
+	if item.trailing {
+		return true, 0
+	}
+	item.trailing = true
+	return true, rest
+}
+
+// record remembers a key purged successfully, which starts a new window of the key
+func (c *dedupeCache) record(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.order.Remove(e)
+	}
+	c.items[key] = c.order.PushFront(&dedupeItem{key: key, purged: time.Now()})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*dedupeItem).key)
+	}
+}
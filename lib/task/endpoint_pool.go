@@ -0,0 +1,141 @@
+package task
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Balance strategies of job runner endpoints
+const (
+	BalanceRoundRobin    = "round-robin"
+	BalanceLeastInFlight = "least-in-flight"
+)
+
+// endpointPool balances jobs between several endpoints and skips the unhealthy ones
+type endpointPool struct {
+	endpoints           []*endpoint
+	balance             string
+	next                uint32
+	healthCheckInterval time.Duration
+	check               func(endpoint string) error
+}
+
+type endpoint struct {
+	url      string
+	inFlight int64
+	mutex    sync.Mutex
+	down     bool
+	checkAt  time.Time
+	checking bool
+}
+
+func newEndpointPool(urls []string, balance string, healthCheckInterval time.Duration, check func(endpoint string) error) (*endpointPool, error) {
+	if len(urls) == 0 {
+		return nil, errors.New("job runner endpoint is required")
+	}
+	if balance == "" {
+		balance = BalanceRoundRobin
+	}
+	if balance != BalanceRoundRobin && balance != BalanceLeastInFlight {
+		return nil, fmt.Errorf("balance must be %v or %v", BalanceRoundRobin, BalanceLeastInFlight)
+	}
+	pool := &endpointPool{
+		balance:             balance,
+		healthCheckInterval: healthCheckInterval,
+		check:               check,
+	}
+	for _, url := range urls {
+		pool.endpoints = append(pool.endpoints, &endpoint{url: url})
+	}
+	return pool, nil
+}
+
+// pick chooses an endpoint for the next job, all endpoints are candidates if none of them is healthy
+func (p *endpointPool) pick() *endpoint {
+	candidates := make([]*endpoint, 0, len(p.endpoints))
+	for _, e := range p.endpoints {
+		if p.healthy(e) {
+			candidates = append(candidates, e)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = p.endpoints
+	}
+
+	if p.balance == BalanceLeastInFlight {
+		// start from a rotating position so endpoints with the same load take turns
+		start := int(atomic.AddUint32(&p.next, 1)) % len(candidates)
+		picked := candidates[start]
+		for i := 1; i < len(candidates); i++ {
+			e := candidates[(start+i)%len(candidates)]
+			if atomic.LoadInt64(&e.inFlight) < atomic.LoadInt64(&picked.inFlight) {
+				picked = e
+			}
+		}
+		return picked
+	}
+	return candidates[int(atomic.AddUint32(&p.next, 1)-1)%len(candidates)]
+}
+
+// healthy reports whether an endpoint is up, and starts a health check of a down endpoint when it's due
+func (p *endpointPool) healthy(e *endpoint) bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if !e.down {
+		return true
+	}
+	if !e.checking && time.Now().After(e.checkAt) {
+		e.checking = true
+		go p.checkEndpoint(e)
+	}
+	return false
+}
+
+// checkEndpoint checks a down endpoint and brings it back to balancing if it's healthy
+func (p *endpointPool) checkEndpoint(e *endpoint) {
+	err := p.check(e.url)
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.checking = false
+	if err != nil {
+		e.checkAt = time.Now().Add(p.healthCheckInterval)
+		log.WithError(err).WithField("endpoint", e.url).Debug("job runner endpoint is still down")
+		return
+	}
+	e.down = false
+	log.WithField("endpoint", e.url).Info("job runner endpoint is up")
+}
+
+// markDown takes an endpoint out of balancing until a health check passes
+func (p *endpointPool) markDown(e *endpoint, err error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.down {
+		return
+	}
+	e.down = true
+	e.checkAt = time.Now().Add(p.healthCheckInterval)
+	log.WithError(err).WithField("endpoint", e.url).Warn("job runner endpoint is down")
+}
+
+// hasHealthy reports whether any endpoint other than e is up, so a failed job can fail over immediately
+func (p *endpointPool) hasHealthy(except *endpoint) bool {
+	for _, e := range p.endpoints {
+		if e == except {
+			continue
+		}
+		e.mutex.Lock()
+		down := e.down
+		e.mutex.Unlock()
+		if !down {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package task
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/mudkipme/timburr/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// FastCGITask executes a MediaWiki job by sending it to PHP-FPM directly
+const FastCGITask = "fastcgi"
+
+func init() {
+	Register(FastCGITask, Definition{
+		NewConfig: func() interface{} {
+			config := utils.CurrentConfig().FastCGI
+			return &config
+		},
+		New: func(config interface{}) (Executor, error) {
+			return NewFastCGIExecutor(config.(*utils.FastCGIConfig))
+		},
+	})
+}
+
+// fastCGITransport sends jobs to rest.php as FastCGI requests, endpoints are addresses of PHP-FPM
+type fastCGITransport struct {
+	client *fcgiClient
+	params map[string]string
+}
+
+// NewFastCGIExecutor creates an executor which sends jobs to PHP-FPM,
+// it works the same as the job runner executor except for the transport
+func NewFastCGIExecutor(config *utils.FastCGIConfig) (*JobRunnerExecutor, error) {
+	scriptName := config.ScriptName
+	if scriptName == "" {
+		scriptName = "/rest.php"
+	}
+	pathInfo := config.PathInfo
+	if pathInfo == "" {
+		pathInfo = "/eventbus/v0/internal/job/execute"
+	}
+	poolSize := config.PoolSize
+	if poolSize < 0 {
+		poolSize = 0
+	}
+	dialTimeout := time.Duration(config.DialTimeout) * time.Millisecond
+	if dialTimeout <= 0 {
+		dialTimeout = 5 * time.Second
+	}
+	timeout := time.Duration(config.Timeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = 180 * time.Second
+	}
+
+	params := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "timburr",
+		"SERVER_PROTOCOL":   "HTTP/1.1",
+		"SERVER_NAME":       "localhost",
+		"SERVER_PORT":       "80",
+		"REMOTE_ADDR":       "127.0.0.1",
+		"REQUEST_METHOD":    "POST",
+		"CONTENT_TYPE":      "application/json",
+		"SCRIPT_FILENAME":   config.ScriptFilename,
+		"SCRIPT_NAME":       scriptName,
+		"PATH_INFO":         pathInfo,
+		"REQUEST_URI":       scriptName + pathInfo,
+		"DOCUMENT_URI":      scriptName + pathInfo,
+		"QUERY_STRING":      "",
+	}
+	for k, v := range config.Params {
+		params[k] = v
+	}
+
+	return newJobExecutor(FastCGITask, &config.JobRunnerConfig, &fastCGITransport{
+		client: newFCGIClient(poolSize, dialTimeout, timeout),
+		params: params,
+	})
+}
+
+func (f *fastCGITransport) execute(endpoint string, message []byte) (int, []byte, error) {
+	params := make(map[string]string, len(f.params)+1)
+	for k, v := range f.params {
+		params[k] = v
+	}
+	params["CONTENT_LENGTH"] = strconv.Itoa(len(message))
+	resp, err := f.client.do(endpoint, params, message)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(resp.stderr) > 0 {
+		log.WithField("endpoint", endpoint).WithField("stderr", string(resp.stderr)).Warn("fastcgi stderr output")
+	}
+	return resp.status, resp.body, nil
+}
+
+func (f *fastCGITransport) check(endpoint string) error {
+	return f.client.check(endpoint)
+}
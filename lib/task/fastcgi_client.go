@@ -0,0 +1,316 @@
+package task
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// FastCGI record types, see https://fastcgi-archives.github.io/FastCGI_Specification.html
+const (
+	fcgiVersion      = 1
+	fcgiBeginRequest = 1
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+
+	fcgiResponder = 1
+	fcgiKeepConn  = 1
+
+	fcgiRequestComplete = 0
+	fcgiMaxContent      = 65535
+	fcgiHeaderLen       = 8
+)
+
+// fcgiClient sends requests to FastCGI servers like PHP-FPM, and keeps idle connections of each address if poolSize is set.
+// A kept connection occupies a PHP-FPM worker while it's idle
+type fcgiClient struct {
+	poolSize    int
+	dialTimeout time.Duration
+	timeout     time.Duration
+	mutex       sync.Mutex
+	idle        map[string]chan net.Conn
+}
+
+// fcgiResponse is the CGI response of a request
+type fcgiResponse struct {
+	status int
+	header textproto.MIMEHeader
+	body   []byte
+	stderr []byte
+}
+
+func newFCGIClient(poolSize int, dialTimeout time.Duration, timeout time.Duration) *fcgiClient {
+	return &fcgiClient{
+		poolSize:    poolSize,
+		dialTimeout: dialTimeout,
+		timeout:     timeout,
+		idle:        make(map[string]chan net.Conn),
+	}
+}
+
+// fcgiAddress parses an address like "127.0.0.1:9000", "tcp://127.0.0.1:9000" or "unix:///run/php/php-fpm.sock"
+func fcgiAddress(address string) (string, string) {
+	if strings.HasPrefix(address, "unix:") {
+		return "unix", strings.TrimPrefix(strings.TrimPrefix(address, "unix:"), "//")
+	}
+	return "tcp", strings.TrimPrefix(address, "tcp://")
+}
+
+func (c *fcgiClient) pool(address string) chan net.Conn {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	idle, ok := c.idle[address]
+	if !ok {
+		idle = make(chan net.Conn, c.poolSize)
+		c.idle[address] = idle
+	}
+	return idle
+}
+
+func (c *fcgiClient) dial(address string) (net.Conn, error) {
+	network, addr := fcgiAddress(address)
+	return net.DialTimeout(network, addr, c.dialTimeout)
+}
+
+// get returns an idle connection or dials a new one
+func (c *fcgiClient) get(address string) (net.Conn, bool, error) {
+	for {
+		select {
+		case conn := <-c.pool(address):
+			if isOpen(conn) {
+				return conn, true, nil
+			}
+			// php-fpm closes idle connections after a while
+			conn.Close()
+			continue
+		default:
+		}
+		conn, err := c.dial(address)
+		return conn, false, err
+	}
+}
+
+// put keeps a connection for the next request, or closes it if the pool is full
+func (c *fcgiClient) put(address string, conn net.Conn) {
+	select {
+	case c.pool(address) <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// do sends a request with params and stdin. The request is sent again with a new connection only if it failed to be
+// written to a stale idle connection, a failed response is never retried here since the job may have been started
+func (c *fcgiClient) do(address string, params map[string]string, stdin []byte) (*fcgiResponse, error) {
+	conn, reused, err := c.get(address)
+	if err != nil {
+		return nil, err
+	}
+	err = c.writeRequest(conn, params, stdin)
+	if err != nil && reused && isStale(err) {
+		conn.Close()
+		if conn, err = c.dial(address); err != nil {
+			return nil, err
+		}
+		err = c.writeRequest(conn, params, stdin)
+	}
+	var resp *fcgiResponse
+	if err == nil {
+		resp, err = c.readResponse(conn)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if c.poolSize > 0 {
+		c.put(address, conn)
+	} else {
+		conn.Close()
+	}
+	return resp, nil
+}
+
+// check dials an address to find out whether the FastCGI server is up
+func (c *fcgiClient) check(address string) error {
+	conn, err := c.dial(address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// requestID is the id of requests, a connection sends one request at a time
+const requestID = 1
+
+func (c *fcgiClient) writeRequest(conn net.Conn, params map[string]string, stdin []byte) error {
+	if c.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+	// php-fpm closes the connection after the response unless it's kept for the pool
+	var flags byte
+	if c.poolSize > 0 {
+		flags = fcgiKeepConn
+	}
+	w := bufio.NewWriter(conn)
+	begin := []byte{0, fcgiResponder, flags, 0, 0, 0, 0, 0}
+	if err := writeRecord(w, fcgiBeginRequest, requestID, begin); err != nil {
+		return err
+	}
+	if err := writeStream(w, fcgiParams, requestID, encodeParams(params)); err != nil {
+		return err
+	}
+	if err := writeStream(w, fcgiStdin, requestID, stdin); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func (c *fcgiClient) readResponse(conn net.Conn) (*fcgiResponse, error) {
+	defer conn.SetDeadline(time.Time{})
+	var stdout, stderr bytes.Buffer
+	r := bufio.NewReader(conn)
+	for {
+		recType, id, content, err := readRecord(r)
+		if err != nil {
+			return nil, err
+		}
+		if id != requestID {
+			continue
+		}
+		switch recType {
+		case fcgiStdout:
+			stdout.Write(content)
+		case fcgiStderr:
+			stderr.Write(content)
+		case fcgiEndRequest:
+			if len(content) < 8 {
+				return nil, errors.New("fastcgi: invalid end request record")
+			}
+			if content[4] != fcgiRequestComplete {
+				return nil, fmt.Errorf("fastcgi: request not complete, protocol status %v", content[4])
+			}
+			resp, err := parseCGIResponse(stdout.Bytes())
+			if err != nil {
+				return nil, err
+			}
+			resp.stderr = stderr.Bytes()
+			return resp, nil
+		}
+	}
+}
+
+func writeRecord(w io.Writer, recType byte, id uint16, content []byte) error {
+	padding := (8 - len(content)%8) % 8
+	header := [fcgiHeaderLen]byte{fcgiVersion, recType}
+	binary.BigEndian.PutUint16(header[2:4], id)
+	binary.BigEndian.PutUint16(header[4:6], uint16(len(content)))
+	header[6] = byte(padding)
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(content); err != nil {
+		return err
+	}
+	_, err := w.Write(make([]byte, padding))
+	return err
+}
+
+// writeStream writes content in records of the maximum length, followed by an empty record to end the stream
+func writeStream(w io.Writer, recType byte, id uint16, content []byte) error {
+	for len(content) > 0 {
+		n := len(content)
+		if n > fcgiMaxContent {
+			n = fcgiMaxContent
+		}
+		if err := writeRecord(w, recType, id, content[:n]); err != nil {
+			return err
+		}
+		content = content[n:]
+	}
+	return writeRecord(w, recType, id, nil)
+}
+
+func readRecord(r io.Reader) (byte, uint16, []byte, error) {
+	var header [fcgiHeaderLen]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, 0, nil, err
+	}
+	if header[0] != fcgiVersion {
+		return 0, 0, nil, fmt.Errorf("fastcgi: invalid version %v", header[0])
+	}
+	id := binary.BigEndian.Uint16(header[2:4])
+	length := int(binary.BigEndian.Uint16(header[4:6]))
+	content := make([]byte, length+int(header[6]))
+	if _, err := io.ReadFull(r, content); err != nil {
+		return 0, 0, nil, err
+	}
+	return header[1], id, content[:length], nil
+}
+
+func encodeParams(params map[string]string) []byte {
+	var buf bytes.Buffer
+	for k, v := range params {
+		writeParamLen(&buf, len(k))
+		writeParamLen(&buf, len(v))
+		buf.WriteString(k)
+		buf.WriteString(v)
+	}
+	return buf.Bytes()
+}
+
+func writeParamLen(buf *bytes.Buffer, n int) {
+	if n < 128 {
+		buf.WriteByte(byte(n))
+		return
+	}
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(n)|1<<31)
+	buf.Write(b[:])
+}
+
+// parseCGIResponse parses the headers and body written by a CGI script, the status is 200 without a Status header
+func parseCGIResponse(stdout []byte) (*fcgiResponse, error) {
+	r := bufio.NewReader(bytes.NewReader(stdout))
+	header, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("fastcgi: invalid response header: %v", err)
+	}
+	resp := &fcgiResponse{status: 200, header: header}
+	if status := header.Get("Status"); status != "" {
+		code := strings.SplitN(status, " ", 2)[0]
+		if resp.status, err = strconv.Atoi(code); err != nil {
+			return nil, fmt.Errorf("fastcgi: invalid status %v", status)
+		}
+	}
+	resp.body, _ = ioutil.ReadAll(r)
+	return resp, nil
+}
+
+// isOpen reports whether an idle connection is still open, nothing should be read from it
+func isOpen(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	defer conn.SetReadDeadline(time.Time{})
+	var b [1]byte
+	_, err := conn.Read(b[:])
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// isStale reports whether a request failed because the connection was closed by the server
+func isStale(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET)
+}
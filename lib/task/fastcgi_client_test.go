@@ -0,0 +1,230 @@
+package task
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fcgiListener counts accepted connections and requests, and can close connections to make idle connections of the client stale
+type fcgiListener struct {
+	net.Listener
+	mutex    sync.Mutex
+	conns    []net.Conn
+	requests int
+}
+
+func (l *fcgiListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.mutex.Lock()
+		l.conns = append(l.conns, conn)
+		l.mutex.Unlock()
+	}
+	return conn, err
+}
+
+func (l *fcgiListener) accepted() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return len(l.conns)
+}
+
+func (l *fcgiListener) closeConns() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+}
+
+func serveFCGI(t *testing.T) *fcgiListener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &fcgiListener{Listener: ln}
+	go fcgi.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.mutex.Lock()
+		l.requests++
+		l.mutex.Unlock()
+		if r.URL.Query().Get("close") != "" {
+			// the connection is lost after the job started
+			l.closeConns()
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		sum := sha1.Sum(body)
+		w.Header().Set("X-Body-Length", strconv.Itoa(len(body)))
+		w.Header().Set("X-Body-Sha1", hex.EncodeToString(sum[:]))
+		if status := r.URL.Query().Get("status"); status != "" {
+			code, _ := strconv.Atoi(status)
+			w.WriteHeader(code)
+		}
+		w.Write([]byte("job executed"))
+	}))
+	return l
+}
+
+func jobParams(uri string, body []byte) map[string]string {
+	return map[string]string{
+		"REQUEST_METHOD":  "POST",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"REQUEST_URI":     uri,
+		"SCRIPT_FILENAME": "/srv/mediawiki/rpc/RunSingleJob.php",
+		"CONTENT_TYPE":    "application/json",
+		"CONTENT_LENGTH":  strconv.Itoa(len(body)),
+	}
+}
+
+func TestFCGIClientLargeBody(t *testing.T) {
+	l := serveFCGI(t)
+	defer l.Close()
+	c := newFCGIClient(2, time.Second, 5*time.Second)
+
+	// the body is split into several stdin records of at most 65535 bytes
+	body := bytes.Repeat([]byte(`{"type":"refreshLinks"}`), 10000)
+	resp, err := c.do(l.Addr().String(), jobParams("/rpc/RunSingleJob.php", body), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha1.Sum(body)
+	if resp.status != http.StatusOK {
+		t.Errorf("status = %v, want 200", resp.status)
+	}
+	if got := resp.header.Get("X-Body-Length"); got != strconv.Itoa(len(body)) {
+		t.Errorf("body length = %v, want %v", got, len(body))
+	}
+	if got := resp.header.Get("X-Body-Sha1"); got != hex.EncodeToString(sum[:]) {
+		t.Errorf("body sha1 = %v, want %v", got, hex.EncodeToString(sum[:]))
+	}
+	if string(resp.body) != "job executed" {
+		t.Errorf("body = %q, want %q", resp.body, "job executed")
+	}
+}
+
+func TestFCGIClientStatus(t *testing.T) {
+	l := serveFCGI(t)
+	defer l.Close()
+	c := newFCGIClient(2, time.Second, 5*time.Second)
+
+	for _, status := range []int{http.StatusOK, http.StatusNotFound, http.StatusServiceUnavailable} {
+		body := []byte(`{"type":"refreshLinks"}`)
+		resp, err := c.do(l.Addr().String(), jobParams("/rpc/RunSingleJob.php?status="+strconv.Itoa(status), body), body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.status != status {
+			t.Errorf("status = %v, want %v", resp.status, status)
+		}
+	}
+}
+
+func TestFCGIClientKeepConn(t *testing.T) {
+	l := serveFCGI(t)
+	defer l.Close()
+	c := newFCGIClient(2, time.Second, 5*time.Second)
+
+	body := []byte(`{"type":"refreshLinks"}`)
+	for i := 0; i < 3; i++ {
+		if _, err := c.do(l.Addr().String(), jobParams("/rpc/RunSingleJob.php", body), body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := l.accepted(); n != 1 {
+		t.Errorf("%v connections accepted, want 1", n)
+	}
+}
+
+func TestFCGIClientStaleConn(t *testing.T) {
+	l := serveFCGI(t)
+	defer l.Close()
+	c := newFCGIClient(2, time.Second, 5*time.Second)
+
+	body := []byte(`{"type":"refreshLinks"}`)
+	if _, err := c.do(l.Addr().String(), jobParams("/rpc/RunSingleJob.php", body), body); err != nil {
+		t.Fatal(err)
+	}
+
+	// the idle connection is closed by the server, the request is sent again with a new connection
+	l.closeConns()
+	time.Sleep(50 * time.Millisecond)
+	resp, err := c.do(l.Addr().String(), jobParams("/rpc/RunSingleJob.php", body), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.status != http.StatusOK {
+		t.Errorf("status = %v, want 200", resp.status)
+	}
+	if n := l.accepted(); n != 2 {
+		t.Errorf("%v connections accepted, want 2", n)
+	}
+}
+
+func TestFCGIClientNoKeepConn(t *testing.T) {
+	l := serveFCGI(t)
+	defer l.Close()
+	c := newFCGIClient(0, time.Second, 5*time.Second)
+
+	// without a pool, php-fpm closes each connection after the response
+	body := []byte(`{"type":"refreshLinks"}`)
+	for i := 0; i < 3; i++ {
+		if _, err := c.do(l.Addr().String(), jobParams("/rpc/RunSingleJob.php", body), body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := l.accepted(); n != 3 {
+		t.Errorf("%v connections accepted, want 3", n)
+	}
+	if n := len(c.pool(l.Addr().String())); n != 0 {
+		t.Errorf("%v idle connections kept, want 0", n)
+	}
+}
+
+func TestFCGIClientReadError(t *testing.T) {
+	l := serveFCGI(t)
+	defer l.Close()
+	c := newFCGIClient(2, time.Second, 5*time.Second)
+
+	body := []byte(`{"type":"refreshLinks"}`)
+	if _, err := c.do(l.Addr().String(), jobParams("/rpc/RunSingleJob.php", body), body); err != nil {
+		t.Fatal(err)
+	}
+
+	// the request is written to the kept connection, which is closed before the response,
+	// so it's not sent again since the job may have been started
+	if _, err := c.do(l.Addr().String(), jobParams("/rpc/RunSingleJob.php?close=1", body), body); err == nil {
+		t.Error("do succeeded without a response")
+	}
+	l.mutex.Lock()
+	requests := l.requests
+	l.mutex.Unlock()
+	if requests != 2 {
+		t.Errorf("%v requests received, want 2", requests)
+	}
+}
+
+func TestFCGIClientDialError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := ln.Addr().String()
+	ln.Close()
+
+	c := newFCGIClient(2, time.Second, 5*time.Second)
+	if err := c.check(address); err == nil {
+		t.Error("check succeeded on a closed port")
+	}
+	if _, err := c.do(address, jobParams("/rpc/RunSingleJob.php", nil), nil); err == nil {
+		t.Error("do succeeded on a closed port")
+	}
+}
@@ -0,0 +1,106 @@
+package task
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+const htcpOpCLR = 4
+
+var htcpTransID = rand.New(rand.NewSource(time.Now().UnixNano())).Uint32()
+
+// htcpCLRPacket encodes an HTCP CLR packet the same way as MediaWiki's HTCPPurger,
+// which is pack('nxxnCxNxxa*n', $htcpLen, $htcpDataLen, $htcpOpCLR, $htcpTransID, $htcpSpecifier, 2)
+func htcpCLRPacket(transID uint32, url string) []byte {
+	// the specifier is pack('na4na*na8n', 4, 'HEAD', strlen($url), $url, 8, 'HTTP/1.0', 0)
+	var specifier bytes.Buffer
+	binary.Write(&specifier, binary.BigEndian, uint16(4))
+	specifier.WriteString("HEAD")
+	binary.Write(&specifier, binary.BigEndian, uint16(len(url)))
+	specifier.WriteString(url)
+	binary.Write(&specifier, binary.BigEndian, uint16(8))
+	specifier.WriteString("HTTP/1.0")
+	binary.Write(&specifier, binary.BigEndian, uint16(0))
+
+	dataLen := 8 + 2 + specifier.Len()
+	var packet bytes.Buffer
+	binary.Write(&packet, binary.BigEndian, uint16(4+dataLen+2))
+	packet.Write([]byte{0, 0})
+	binary.Write(&packet, binary.BigEndian, uint16(dataLen))
+	packet.Write([]byte{htcpOpCLR, 0})
+	binary.Write(&packet, binary.BigEndian, transID)
+	packet.Write([]byte{0, 0})
+	packet.Write(specifier.Bytes())
+	binary.Write(&packet, binary.BigEndian, uint16(2))
+	return packet.Bytes()
+}
+
+// htcpSender sends HTCP CLR packets of a purge, with one socket for each multicast ttl
+type htcpSender struct {
+	mutex sync.Mutex
+	conns map[int]*net.UDPConn
+}
+
+func newHTCPSender() *htcpSender {
+	return &htcpSender{conns: make(map[int]*net.UDPConn)}
+}
+
+// conn returns the socket of a multicast ttl, it's opened when it's used for the first time
+func (s *htcpSender) conn(ttl int) (*net.UDPConn, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if conn, ok := s.conns[ttl]; ok {
+		return conn, nil
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	if ttl > 0 {
+		if err := ipv4.NewPacketConn(conn).SetMulticastTTL(ttl); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	s.conns[ttl] = conn
+	return conn, nil
+}
+
+// send sends an HTCP CLR packet of a url to each address, which can be a multicast group or a unicast address
+func (s *htcpSender) send(url string, addresses []string, ttl int) error {
+	if len(addresses) == 0 {
+		return errors.New("no htcp address")
+	}
+	conn, err := s.conn(ttl)
+	if err != nil {
+		return err
+	}
+	packet := htcpCLRPacket(atomic.AddUint32(&htcpTransID, 1), url)
+	for _, address := range addresses {
+		addr, err := net.ResolveUDPAddr("udp4", address)
+		if err != nil {
+			return err
+		}
+		if _, err := conn.WriteToUDP(packet, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *htcpSender) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for ttl, conn := range s.conns {
+		conn.Close()
+		delete(s.conns, ttl)
+	}
+}
@@ -0,0 +1,74 @@
+package task
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+)
+
+// pack('nxxnCxNxxa*n', 71, 65, 4, 0x01020304, pack('na4na*na8n', 4, 'HEAD', 35, 'http://wiki.52poke.com/wiki/Pikachu', 8, 'HTTP/1.0', 0), 2)
+const htcpPikachu = "0047" + "0000" + "0041" + "04" + "00" + "01020304" + "0000" +
+	"0004" + "48454144" + "0023" + "687474703a2f2f77696b692e3532706f6b652e636f6d2f77696b692f50696b61636875" +
+	"0008" + "485454502f312e30" + "0000" + "0002"
+
+func TestHTCPCLRPacket(t *testing.T) {
+	want, _ := hex.DecodeString(htcpPikachu)
+	got := htcpCLRPacket(0x01020304, "http://wiki.52poke.com/wiki/Pikachu")
+	if !bytes.Equal(got, want) {
+		t.Errorf("htcpCLRPacket\n got %x\nwant %x", got, want)
+	}
+}
+
+func TestHTCPSender(t *testing.T) {
+	listeners := []*net.UDPConn{}
+	addresses := []string{}
+	for i := 0; i < 2; i++ {
+		l, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		l.SetReadDeadline(time.Now().Add(5 * time.Second))
+		listeners = append(listeners, l)
+		addresses = append(addresses, l.LocalAddr().String())
+	}
+
+	s := newHTCPSender()
+	defer s.close()
+	urls := []string{"http://wiki.52poke.com/wiki/Pikachu", "http://wiki.52poke.com/wiki/Raichu"}
+	for _, url := range urls {
+		if err := s.send(url, addresses, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// every packet is sent from the same socket
+	var source string
+	buf := make([]byte, 2048)
+	for _, l := range listeners {
+		for _, url := range urls {
+			n, addr, err := l.ReadFromUDP(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			packet := buf[:n]
+			// the transaction id is not compared
+			want := htcpCLRPacket(0, url)
+			copy(packet[8:12], []byte{0, 0, 0, 0})
+			if !bytes.Equal(packet, want) {
+				t.Errorf("packet\n got %x\nwant %x", packet, want)
+			}
+			if source == "" {
+				source = addr.String()
+			} else if addr.String() != source {
+				t.Errorf("packet sent from %v, want %v", addr, source)
+			}
+		}
+	}
+
+	if err := s.send(urls[0], nil, 1); err == nil {
+		t.Error("send succeeded without addresses")
+	}
+}
@@ -2,84 +2,332 @@ package task
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"path"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/mudkipme/timburr/metrics"
 	"github.com/mudkipme/timburr/utils"
 	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
 )
 
 // JobRunnerExecutor executes MediaWiki jobs via event bus
 type JobRunnerExecutor struct {
-	endpoint      string
-	excludeFields []string
-	client        *http.Client
+	taskType         string
+	transport        jobTransport
+	pool             *endpointPool
+	routes           []jobRoute
+	excludeFields    []string
+	secretKey        string
+	invalidSignature string
+	retryAttempts    int
+	retryBackoff     time.Duration
 }
 
-// DefaultJobRunnerExecutor creates a job runner executor based on config.yml
-func DefaultJobRunnerExecutor() *JobRunnerExecutor {
-	return NewJobRunnerExecutor(utils.Config.JobRunner.Endpoint, utils.Config.JobRunner.ExcludeFields)
+// jobTransport sends a job to RunSingleJob of an endpoint
+type jobTransport interface {
+	// execute returns the http status and the body of the response
+	execute(endpoint string, message []byte) (int, []byte, error)
+	// check returns an error if the endpoint is down
+	check(endpoint string) error
+}
+
+// httpTransport sends jobs to rest.php via http
+type httpTransport struct {
+	client      *http.Client
+	checkClient *http.Client
+}
+
+func (h *httpTransport) execute(endpoint string, message []byte) (int, []byte, error) {
+	resp, err := h.client.Post(endpoint, "application/json", bytes.NewBuffer(message))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, body, err
+}
+
+// check requests an endpoint, which is healthy if it responds without a server error
+func (h *httpTransport) check(endpoint string) error {
+	resp, err := h.checkClient.Get(endpoint)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("status: %v", resp.StatusCode)
+	}
+	return nil
+}
+
+// jobRoute sends jobs whose type matches one of types to its own pool
+type jobRoute struct {
+	types []string
+	pool  *endpointPool
+}
+
+// Actions to invalid signatures of jobs
+const (
+	InvalidSignatureReject = "reject"
+	InvalidSignatureFlag   = "flag"
+)
+
+func init() {
+	Register(JobRunnerTask, Definition{
+		NewConfig: func() interface{} {
+			config := utils.CurrentConfig().JobRunner
+			return &config
+		},
+		New: func(config interface{}) (Executor, error) {
+			return NewJobRunnerExecutor(config.(*utils.JobRunnerConfig))
+		},
+	})
 }
 
 // NewJobRunnerExecutor creates a new job runner executor
-func NewJobRunnerExecutor(endpoint string, excludeFields []string) *JobRunnerExecutor {
-	return &JobRunnerExecutor{
-		endpoint:      endpoint,
-		excludeFields: excludeFields,
+func NewJobRunnerExecutor(config *utils.JobRunnerConfig) (*JobRunnerExecutor, error) {
+	return newJobExecutor(JobRunnerTask, config, &httpTransport{
 		client: &http.Client{
 			Timeout: time.Second * 180,
 		},
+		checkClient: &http.Client{
+			Timeout: time.Second * 5,
+		},
+	})
+}
+
+// newJobExecutor creates an executor of MediaWiki jobs sent by a transport
+func newJobExecutor(taskType string, config *utils.JobRunnerConfig, transport jobTransport) (*JobRunnerExecutor, error) {
+	healthCheckInterval := time.Duration(config.HealthCheckInterval) * time.Millisecond
+	if healthCheckInterval <= 0 {
+		healthCheckInterval = 10 * time.Second
+	}
+	endpoints := config.Endpoints
+	if len(endpoints) == 0 && config.Endpoint != "" {
+		endpoints = []string{config.Endpoint}
+	}
+	pool, err := newEndpointPool(endpoints, config.Balance, healthCheckInterval, transport.check)
+	if err != nil {
+		return nil, err
+	}
+	routes := []jobRoute{}
+	for _, r := range config.Routes {
+		for _, pattern := range r.Types {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid job type pattern %v: %v", pattern, err)
+			}
+		}
+		routePool, err := newEndpointPool(r.Endpoints, r.Balance, healthCheckInterval, transport.check)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route of %v: %v", r.Types, err)
+		}
+		routes = append(routes, jobRoute{types: r.Types, pool: routePool})
 	}
+	invalidSignature := config.InvalidSignature
+	if invalidSignature == "" {
+		invalidSignature = InvalidSignatureReject
+	}
+	if invalidSignature != InvalidSignatureReject && invalidSignature != InvalidSignatureFlag {
+		return nil, fmt.Errorf("invalid signature action must be %v or %v", InvalidSignatureReject, InvalidSignatureFlag)
+	}
+	retryAttempts := config.RetryAttempts
+	if retryAttempts <= 0 {
+		retryAttempts = 4
+	}
+	retryBackoff := time.Duration(config.RetryBackoff) * time.Millisecond
+	if retryBackoff <= 0 {
+		retryBackoff = time.Second
+	}
+	return &JobRunnerExecutor{
+		taskType:         taskType,
+		transport:        transport,
+		pool:             pool,
+		routes:           routes,
+		excludeFields:    config.ExcludeFields,
+		secretKey:        config.SecretKey,
+		invalidSignature: invalidSignature,
+		retryAttempts:    retryAttempts,
+		retryBackoff:     retryBackoff,
+	}, nil
 }
 
 // Execute sends a job in the kafka message to the endpoint
 func (t *JobRunnerExecutor) Execute(message []byte) error {
-	var messageMap map[string]interface{}
-	if err := json.Unmarshal(message, &messageMap); err != nil {
-		return err
-	}
-	for _, f := range t.excludeFields {
-		delete(messageMap, f)
-	}
-	rb, err := json.Marshal(messageMap)
+	rb, err := excludeFields(message, t.excludeFields)
 	if err != nil {
-		return err
+		return &ExecuteError{Err: err, Attempts: 1, Permanent: true}
 	}
-	err = t.retryExecute(rb, 4, time.Second)
+	if t.secretKey != "" {
+		if rb, err = t.sign(rb); err != nil {
+			return &ExecuteError{Err: err, Attempts: 1, Permanent: true}
+		}
+	}
+	err = t.retryExecute(t.route(rb), rb, t.retryAttempts, t.retryBackoff)
 	if err != nil {
 		return err
 	}
+	var messageMap map[string]interface{}
+	json.Unmarshal(rb, &messageMap)
 	log.WithFields(log.Fields(messageMap)).Info("job executed")
 	return nil
 }
 
-func (t *JobRunnerExecutor) retryExecute(message []byte, times int, wait time.Duration) error {
-	if err := t.doExecute(message); err != nil {
-		times--
-		if times > 0 {
-			time.Sleep(wait)
-			return t.retryExecute(message, times, 2*wait)
+// route returns the endpoint pool of a job by its type
+func (t *JobRunnerExecutor) route(message []byte) *endpointPool {
+	jobType := gjson.GetBytes(message, "type").String()
+	for _, r := range t.routes {
+		for _, pattern := range r.types {
+			if matched, _ := path.Match(pattern, jobType); matched {
+				return r.pool
+			}
 		}
-		return err
 	}
-	return nil
+	return t.pool
 }
 
-func (t *JobRunnerExecutor) doExecute(message []byte) error {
-	resp, err := http.Post(t.endpoint, "application/json", bytes.NewBuffer(message))
+// sign verifies the original signature of a job and signs it again, so it's still valid after excluding fields,
+// a flagged job with an invalid signature is never signed, and is sent with its original signature
+func (t *JobRunnerExecutor) sign(message []byte) ([]byte, error) {
+	signature, err := jobSignature(message, t.secretKey)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	original := gjson.GetBytes(message, signatureField).String()
+	if !hmac.Equal([]byte(original), []byte(signature)) {
+		metrics.InvalidSignatures.WithLabelValues(t.invalidSignature).Inc()
+		if t.invalidSignature == InvalidSignatureReject {
+			return nil, errors.New("invalid job signature")
+		}
+		log.WithField("type", gjson.GetBytes(message, "type").String()).
+			WithField("id", gjson.GetBytes(message, "meta.id").String()).
+			Warn("invalid job signature")
+		return message, nil
+	}
+	return sjson.SetBytes(message, signatureField, signature)
+}
+
+// excludeFields removes fields from a JSON message without touching the rest of the bytes,
+// so the key order and numbers are preserved for the signature to be verified
+func excludeFields(message []byte, fields []string) ([]byte, error) {
+	if !gjson.ValidBytes(message) {
+		return nil, errors.New("invalid json message")
+	}
+	var err error
+	for _, f := range fields {
+		if message, err = sjson.DeleteBytes(message, escapePath(f)); err != nil {
+			return nil, fmt.Errorf("exclude field %v failed: %v", f, err)
+		}
+	}
+	return message, nil
+}
+
+// escapePath escapes the characters which have special meanings in gjson paths except dots,
+// so "@timestamp" is a plain key while "meta.request_id" is still a nested one
+func escapePath(path string) string {
+	var sb strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if c == '\\' && i+1 < len(path) {
+			sb.WriteByte(c)
+			i++
+			sb.WriteByte(path[i])
+			continue
+		}
+		if strings.IndexByte("@*?#|!:", c) >= 0 {
+			sb.WriteByte('\\')
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String()
+}
+
+// retryExecute retries a job with exponential backoff until it succeeds or fails permanently,
+// a job fails over to another endpoint without waiting if the endpoint is down
+func (t *JobRunnerExecutor) retryExecute(pool *endpointPool, message []byte, times int, wait time.Duration) error {
+	var err error
+	for attempt := 1; attempt <= times; attempt++ {
+		e := pool.pick()
+		atomic.AddInt64(&e.inFlight, 1)
+		err = t.doExecute(e.url, message)
+		atomic.AddInt64(&e.inFlight, -1)
+		if err == nil {
+			return nil
+		}
+		var permanent *permanentError
+		if errors.As(err, &permanent) {
+			return &ExecuteError{Err: permanent.err, Attempts: attempt, Permanent: true}
+		}
+		var unavailable *unavailableError
+		failover := false
+		if errors.As(err, &unavailable) {
+			pool.markDown(e, err)
+			failover = pool.hasHealthy(e)
+		}
+		if attempt < times {
+			metrics.ExecuteRetries.WithLabelValues(t.taskType).Inc()
+			if !failover {
+				time.Sleep(wait)
+				wait *= 2
+			}
+		}
+	}
+	return &ExecuteError{Err: err, Attempts: times}
+}
+
+// permanentError is a failure which won't succeed by retrying, such as a malformed job or a failed job
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+// unavailableError is a failure of the endpoint rather than the job, such as a refused connection or a bad gateway
+type unavailableError struct {
+	err error
+}
+
+func (e *unavailableError) Error() string {
+	return e.err.Error()
+}
+
+// doExecute sends a job to RunSingleJob, whose response is like {"status":false,"error":"..."} when the job fails.
+// 5xx, 408 and 429 responses, timeouts and connection errors are retryable, while other 4xx responses and failed jobs are permanent.
+func (t *JobRunnerExecutor) doExecute(endpoint string, message []byte) error {
+	status, body, err := t.transport.execute(endpoint, message)
 	if err != nil {
-		return err
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return err
+		}
+		return &unavailableError{err}
+	}
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return &unavailableError{fmt.Errorf("job runner endpoint unavailable, status: %v", status)}
+	}
+	if status >= 500 || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests {
+		return fmt.Errorf("job runner execute failed, status: %v, response: %v", status, string(body))
 	}
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("job runner execute failed, response: %v", string(body))
+	if status < 200 || status >= 300 {
+		return &permanentError{fmt.Errorf("job runner rejected the job, status: %v, response: %v", status, string(body))}
+	}
+	if gjson.ValidBytes(body) {
+		if status := gjson.GetBytes(body, "status"); status.Exists() && !status.Bool() {
+			return &permanentError{fmt.Errorf("job failed: %v", gjson.GetBytes(body, "error").String())}
+		}
 	}
 	return nil
 }
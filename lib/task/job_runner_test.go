@@ -0,0 +1,78 @@
+package task
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// fakeTransport responds to every job with the same response
+type fakeTransport struct {
+	status int
+	body   string
+	err    error
+}
+
+func (f *fakeTransport) execute(endpoint string, message []byte) (int, []byte, error) {
+	return f.status, []byte(f.body), f.err
+}
+
+func (f *fakeTransport) check(endpoint string) error {
+	return nil
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestJobRunnerDoExecute(t *testing.T) {
+	const (
+		succeeded   = "succeeded"
+		retryable   = "retryable"
+		unavailable = "unavailable"
+		permanent   = "permanent"
+	)
+	tests := []struct {
+		name      string
+		transport fakeTransport
+		want      string
+	}{
+		{"ok", fakeTransport{status: 200, body: `{"status":true}`}, succeeded},
+		{"no content", fakeTransport{status: 204}, succeeded},
+		{"non-json body", fakeTransport{status: 200, body: "OK"}, succeeded},
+		{"failed job", fakeTransport{status: 200, body: `{"status":false,"error":"Title is invalid"}`}, permanent},
+		{"bad request", fakeTransport{status: 400}, permanent},
+		{"invalid signature", fakeTransport{status: 403}, permanent},
+		{"not found", fakeTransport{status: 404}, permanent},
+		{"redirect", fakeTransport{status: 302}, permanent},
+		{"request timeout", fakeTransport{status: 408}, retryable},
+		{"too many requests", fakeTransport{status: 429}, retryable},
+		{"internal server error", fakeTransport{status: 500}, retryable},
+		{"bad gateway", fakeTransport{status: 502}, unavailable},
+		{"service unavailable", fakeTransport{status: 503}, unavailable},
+		{"gateway timeout", fakeTransport{status: 504}, unavailable},
+		{"timeout", fakeTransport{err: &net.OpError{Op: "read", Err: timeoutError{}}}, retryable},
+		{"connection refused", fakeTransport{err: errors.New("connection refused")}, unavailable},
+	}
+	for _, tt := range tests {
+		transport := tt.transport
+		executor := &JobRunnerExecutor{transport: &transport}
+		err := executor.doExecute("http://127.0.0.1/w/rest.php/eventbus/v0/internal/job/execute", []byte(`{"type":"refreshLinks"}`))
+		got := retryable
+		var perr *permanentError
+		var uerr *unavailableError
+		switch {
+		case err == nil:
+			got = succeeded
+		case errors.As(err, &perr):
+			got = permanent
+		case errors.As(err, &uerr):
+			got = unavailable
+		}
+		if got != tt.want {
+			t.Errorf("%v: doExecute() = %v, which is %v, want %v", tt.name, err, got, tt.want)
+		}
+	}
+}
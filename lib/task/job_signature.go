@@ -0,0 +1,219 @@
+package task
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+const signatureField = "mediawiki_signature"
+
+// jobSignature computes mediawiki_signature of a job the same way as EventBus,
+// which is hash_hmac('sha1', FormatJson::encode($event, false, FormatJson::ALL_OK), $wgSecretKey)
+// of the event decoded as an array, without mediawiki_signature itself
+func jobSignature(message []byte, secretKey string) (string, error) {
+	canonical, err := canonicalJob(message)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha1.New, []byte(secretKey))
+	mac.Write(canonical)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// canonicalJob encodes a job like PHP's json_encode(json_decode($message, true)),
+// keeping the order of keys in the message
+func canonicalJob(message []byte) ([]byte, error) {
+	if !gjson.ValidBytes(message) {
+		return nil, errors.New("invalid json message")
+	}
+	root := gjson.ParseBytes(message)
+	if !root.IsObject() {
+		return nil, errors.New("job is not a json object")
+	}
+	var buf bytes.Buffer
+	writePHPObject(&buf, root, true)
+	return buf.Bytes(), nil
+}
+
+func writePHPValue(buf *bytes.Buffer, r gjson.Result) {
+	switch r.Type {
+	case gjson.Null:
+		buf.WriteString("null")
+	case gjson.True:
+		buf.WriteString("true")
+	case gjson.False:
+		buf.WriteString("false")
+	case gjson.Number:
+		writePHPNumber(buf, r.Raw)
+	case gjson.String:
+		writePHPString(buf, r.Str)
+	case gjson.JSON:
+		if r.IsArray() {
+			writePHPList(buf, r.Array())
+		} else {
+			writePHPObject(buf, r, false)
+		}
+	}
+}
+
+type phpEntry struct {
+	key   string
+	value gjson.Result
+}
+
+// writePHPObject writes a decoded associative array, the root job skips mediawiki_signature
+func writePHPObject(buf *bytes.Buffer, r gjson.Result, root bool) {
+	entries := []phpEntry{}
+	index := make(map[string]int)
+	r.ForEach(func(key, value gjson.Result) bool {
+		if root && key.Str == signatureField {
+			return true
+		}
+		// a duplicated key keeps its first position and its last value in php
+		if i, ok := index[key.Str]; ok {
+			entries[i].value = value
+			return true
+		}
+		index[key.Str] = len(entries)
+		entries = append(entries, phpEntry{key: key.Str, value: value})
+		return true
+	})
+
+	// php arrays with sequential keys from 0, including empty ones, are encoded as lists
+	sequential := true
+	for i, e := range entries {
+		if e.key != strconv.Itoa(i) {
+			sequential = false
+			break
+		}
+	}
+	if sequential {
+		values := make([]gjson.Result, len(entries))
+		for i, e := range entries {
+			values[i] = e.value
+		}
+		writePHPList(buf, values)
+		return
+	}
+
+	buf.WriteByte('{')
+	for i, e := range entries {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		writePHPString(buf, e.key)
+		buf.WriteByte(':')
+		writePHPValue(buf, e.value)
+	}
+	buf.WriteByte('}')
+}
+
+func writePHPList(buf *bytes.Buffer, values []gjson.Result) {
+	buf.WriteByte('[')
+	for i, v := range values {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		writePHPValue(buf, v)
+	}
+	buf.WriteByte(']')
+}
+
+// writePHPNumber keeps integers within int64 and encodes others as php floats
+func writePHPNumber(buf *bytes.Buffer, raw string) {
+	if !strings.ContainsAny(raw, ".eE") {
+		if n, err := strconv.ParseInt(raw, 10, 64); err == nil {
+			buf.WriteString(strconv.FormatInt(n, 10))
+			return
+		}
+	}
+	f, _ := strconv.ParseFloat(raw, 64)
+	buf.WriteString(phpFloat(f))
+}
+
+// phpFloat formats a float like json_encode with serialize_precision = -1
+func phpFloat(f float64) string {
+	if f == 0 {
+		if math.Signbit(f) {
+			return "-0"
+		}
+		return "0"
+	}
+	sign := ""
+	if f < 0 {
+		sign = "-"
+		f = -f
+	}
+	// shortest representation in the form of d.ddde±x
+	s := strconv.FormatFloat(f, 'e', -1, 64)
+	mantissa, exp := s[:strings.IndexByte(s, 'e')], s[strings.IndexByte(s, 'e')+1:]
+	digits := strings.Replace(mantissa, ".", "", 1)
+	e, _ := strconv.Atoi(exp)
+	decpt := e + 1
+
+	if decpt < -3 || decpt > 17 {
+		frac := digits[1:]
+		if frac == "" {
+			frac = "0"
+		}
+		expSign := "+"
+		if e < 0 {
+			expSign = "-"
+			e = -e
+		}
+		return sign + digits[:1] + "." + frac + "e" + expSign + strconv.Itoa(e)
+	}
+	if decpt <= 0 {
+		return sign + "0." + strings.Repeat("0", -decpt) + digits
+	}
+	if decpt >= len(digits) {
+		return sign + digits + strings.Repeat("0", decpt-len(digits))
+	}
+	return sign + digits[:decpt] + "." + digits[decpt:]
+}
+
+// writePHPString escapes a string like FormatJson::encode with FormatJson::ALL_OK,
+// unicode and slashes are not escaped except U+2028 and U+2029
+func writePHPString(buf *bytes.Buffer, s string) {
+	const hexDigits = "0123456789abcdef"
+	buf.WriteByte('"')
+	for _, c := range s {
+		switch c {
+		case '"':
+			buf.WriteString(`\"`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\f':
+			buf.WriteString(`\f`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '\u2028':
+			buf.WriteString(`\u2028`)
+		case '\u2029':
+			buf.WriteString(`\u2029`)
+		default:
+			if c < 0x20 {
+				buf.WriteString(`\u00`)
+				buf.WriteByte(hexDigits[c>>4])
+				buf.WriteByte(hexDigits[c&0xf])
+			} else {
+				buf.WriteRune(c)
+			}
+		}
+	}
+	buf.WriteByte('"')
+}
@@ -0,0 +1,155 @@
+package task
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+const testSecretKey = "wgSecretKey-for-tests"
+
+// canonical values are what FormatJson::encode( $event, false, FormatJson::ALL_OK ) produces for json_decode( $message, true )
+var signatureTests = []struct {
+	name      string
+	message   string
+	canonical string
+	signature string
+}{
+	{
+		name:      "refreshLinks",
+		message:   `{"$schema":"\/mediawiki\/job\/1.0.0","meta":{"uri":"https:\/\/wiki.52poke.com\/wiki\/Special:Badtitle\/JobSpecification","request_id":"XtTbcApAICMAAC2tmv0AAAAA","id":"e6a8c8d2-a3f3-11ea-9cf1-0242ac110004","dt":"2020-06-01T12:00:00Z","domain":"wiki.52poke.com","stream":"mediawiki.job.refreshLinks"},"database":"wikidb","type":"refreshLinks","page_namespace":0,"page_title":"\u76ae\u5361\u4e18","params":{"rootJobSignature":"ad4d9e5c29abe4ef2a0f0e84c5d6b0b03a0e9c09","rootJobTimestamp":"20200601120000","causeAction":"edit-page","causeAgent":"Mudkip","namespace":0,"title":"皮卡丘","requestId":"XtTbcApAICMAAC2tmv0AAAAA"},"root_event":{"signature":"ad4d9e5c29abe4ef2a0f0e84c5d6b0b03a0e9c09","dt":"2020-06-01T12:00:00Z"},"mediawiki_signature":"1472bbb8c8db523abb2c99b990335120cacebee2"}`,
+		canonical: `{"$schema":"/mediawiki/job/1.0.0","meta":{"uri":"https://wiki.52poke.com/wiki/Special:Badtitle/JobSpecification","request_id":"XtTbcApAICMAAC2tmv0AAAAA","id":"e6a8c8d2-a3f3-11ea-9cf1-0242ac110004","dt":"2020-06-01T12:00:00Z","domain":"wiki.52poke.com","stream":"mediawiki.job.refreshLinks"},"database":"wikidb","type":"refreshLinks","page_namespace":0,"page_title":"皮卡丘","params":{"rootJobSignature":"ad4d9e5c29abe4ef2a0f0e84c5d6b0b03a0e9c09","rootJobTimestamp":"20200601120000","causeAction":"edit-page","causeAgent":"Mudkip","namespace":0,"title":"皮卡丘","requestId":"XtTbcApAICMAAC2tmv0AAAAA"},"root_event":{"signature":"ad4d9e5c29abe4ef2a0f0e84c5d6b0b03a0e9c09","dt":"2020-06-01T12:00:00Z"}}`,
+		signature: "1472bbb8c8db523abb2c99b990335120cacebee2",
+	},
+	{
+		// empty objects and objects with sequential keys are php lists
+		name:      "htmlCacheUpdate",
+		message:   `{"$schema":"/mediawiki/job/1.0.0","meta":{"uri":"https://wiki.52poke.com/wiki/Special:Badtitle/JobSpecification","id":"0b3c4f6e-a3f4-11ea-9cf1-0242ac110004","dt":"2020-06-01T12:05:00Z","domain":"wiki.52poke.com","stream":"mediawiki.job.htmlCacheUpdate"},"database":"wikidb","mediawiki_signature":"d26e86322dcba3caada2cfee384ffb982c8609e7","type":"htmlCacheUpdate","page_namespace":10,"page_title":"Pokémon_Infobox","params":{"pages":{"1024":[0,"皮卡丘"],"2048":[0,"雷丘"]},"table":"templatelinks","recursive":true,"range":{},"extra":{"0":"a","1":"b"},"reversed":{"1":"a","0":"b"},"causeAction":"page-edit"}}`,
+		canonical: `{"$schema":"/mediawiki/job/1.0.0","meta":{"uri":"https://wiki.52poke.com/wiki/Special:Badtitle/JobSpecification","id":"0b3c4f6e-a3f4-11ea-9cf1-0242ac110004","dt":"2020-06-01T12:05:00Z","domain":"wiki.52poke.com","stream":"mediawiki.job.htmlCacheUpdate"},"database":"wikidb","type":"htmlCacheUpdate","page_namespace":10,"page_title":"Pokémon_Infobox","params":{"pages":{"1024":[0,"皮卡丘"],"2048":[0,"雷丘"]},"table":"templatelinks","recursive":true,"range":[],"extra":["a","b"],"reversed":{"1":"a","0":"b"},"causeAction":"page-edit"}}`,
+		signature: "d26e86322dcba3caada2cfee384ffb982c8609e7",
+	},
+	{
+		// a duplicated key keeps its first position and its last value
+		name:      "duplicates",
+		message:   `{"type":"cdnPurge","database":"wikidb","params":{"urls":["https://wiki.52poke.com/wiki/Pikachu"],"options":{}},"type":"cdnPurgeRetry"}`,
+		canonical: `{"type":"cdnPurgeRetry","database":"wikidb","params":{"urls":["https://wiki.52poke.com/wiki/Pikachu"],"options":[]}}`,
+		signature: "53cf6fa21b3712357d112d965be0721aea496d60",
+	},
+	{
+		name:      "numbers",
+		message:   `{"type":"numbers","params":{"int":123456789012345678,"negativeZero":-0,"one":1,"float":0.1,"oneFloat":1.0,"small":0.0001,"smaller":0.000015,"large":1e16,"larger":1e17,"huge":9223372036854775808,"negativeFloat":-0.0,"fraction":-2.5E-7,"rate":33.333333333333336}}`,
+		canonical: `{"type":"numbers","params":{"int":123456789012345678,"negativeZero":0,"one":1,"float":0.1,"oneFloat":1,"small":0.0001,"smaller":1.5e-5,"large":10000000000000000,"larger":1.0e+17,"huge":9.223372036854776e+18,"negativeFloat":-0,"fraction":-2.5e-7,"rate":33.333333333333336}}`,
+		signature: "974aa6c39b379702769f1ccb99def074353f648b",
+	},
+	{
+		// unicode and slashes are not escaped except U+2028 and U+2029
+		name:      "strings",
+		message:   `{"type":"strings","params":{"summary":"line\u2028separator\u2029paragraph","control":"\u0001\u0008\u000c\n\r\t","quote":"\"quoted\" \\ back","slash":"\/wiki\/Pikachu","emoji":"\u26a1","del":"\u007f"}}`,
+		canonical: `{"type":"strings","params":{"summary":"line\u2028separator\u2029paragraph","control":"\u0001\b\f\n\r\t","quote":"\"quoted\" \\ back","slash":"/wiki/Pikachu","emoji":"⚡","del":"` + "\x7f" + `"}}`,
+		signature: "0236accf526a6a26bcef4aa8aa95142a77cc6ae6",
+	},
+}
+
+func TestJobSignature(t *testing.T) {
+	for _, tt := range signatureTests {
+		canonical, err := canonicalJob([]byte(tt.message))
+		if err != nil {
+			t.Errorf("%v: canonicalJob error: %v", tt.name, err)
+			continue
+		}
+		if string(canonical) != tt.canonical {
+			t.Errorf("%v: canonicalJob\n got %s\nwant %s", tt.name, canonical, tt.canonical)
+		}
+		signature, err := jobSignature([]byte(tt.message), testSecretKey)
+		if err != nil {
+			t.Errorf("%v: jobSignature error: %v", tt.name, err)
+			continue
+		}
+		if signature != tt.signature {
+			t.Errorf("%v: jobSignature = %v, want %v", tt.name, signature, tt.signature)
+		}
+	}
+}
+
+func TestCanonicalJobError(t *testing.T) {
+	for _, message := range []string{``, `{"type":`, `["refreshLinks"]`, `"refreshLinks"`} {
+		if _, err := canonicalJob([]byte(message)); err == nil {
+			t.Errorf("canonicalJob(%q) succeeded, want error", message)
+		}
+	}
+}
+
+func TestPHPFloat(t *testing.T) {
+	tests := []struct {
+		f    float64
+		want string
+	}{
+		{0, "0"},
+		{math.Copysign(0, -1), "-0"},
+		{1, "1"},
+		{-1.5, "-1.5"},
+		{0.1, "0.1"},
+		{1.0 / 3, "0.3333333333333333"},
+		{100.0 / 3, "33.333333333333336"},
+		{1234.5678, "1234.5678"},
+		// fixed notation down to 4 zeros after the decimal point
+		{0.001, "0.001"},
+		{0.0001, "0.0001"},
+		{0.00012, "0.00012"},
+		{0.00001, "1.0e-5"},
+		{-0.000015, "-1.5e-5"},
+		// fixed notation up to 17 digits before the decimal point
+		{1e15, "1000000000000000"},
+		{1e16, "10000000000000000"},
+		{12345678901234567, "12345678901234568"},
+		{1e17, "1.0e+17"},
+		{1.5e17, "1.5e+17"},
+		{-1e20, "-1.0e+20"},
+		{9223372036854775808, "9.223372036854776e+18"},
+		{1e300, "1.0e+300"},
+		{5e-324, "5.0e-324"},
+	}
+	for _, tt := range tests {
+		if got := phpFloat(tt.f); got != tt.want {
+			t.Errorf("phpFloat(%v) = %v, want %v", tt.f, got, tt.want)
+		}
+	}
+}
+
+func TestSign(t *testing.T) {
+	valid := signatureTests[0]
+	forged := strings.Replace(valid.message, `"causeAgent":"Mudkip"`, `"causeAgent":"Forged"`, 1)
+	unsigned := strings.Replace(valid.message, `,"mediawiki_signature":"`+valid.signature+`"`, "", 1)
+	tests := []struct {
+		action  string
+		message string
+		want    string
+	}{
+		{InvalidSignatureReject, valid.message, valid.signature},
+		{InvalidSignatureFlag, valid.message, valid.signature},
+		{InvalidSignatureReject, forged, ""},
+		{InvalidSignatureFlag, forged, valid.signature},
+		{InvalidSignatureReject, unsigned, ""},
+		{InvalidSignatureFlag, unsigned, ""},
+	}
+	for i, tt := range tests {
+		executor := &JobRunnerExecutor{secretKey: testSecretKey, invalidSignature: tt.action}
+		signed, err := executor.sign([]byte(tt.message))
+		if tt.action == InvalidSignatureReject && tt.want == "" {
+			if err == nil {
+				t.Errorf("%v: sign() of an invalid job succeeded", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: sign() error: %v", i, err)
+			continue
+		}
+		// flagged jobs keep their original signature, or none
+		if got := gjson.GetBytes(signed, signatureField).String(); got != tt.want {
+			t.Errorf("%v: sign() signature = %q, want %q", i, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package task
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/mudkipme/timburr/utils"
+	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// ProduceTask transforms a message and produces it to another topic
+const ProduceTask = "produce"
+
+// Producer produces messages to kafka for executors
+type Producer interface {
+	Produce(topic string, key []byte, value []byte) error
+}
+
+var producer Producer
+
+// SetProducer sets the producer shared by produce executors
+func SetProducer(p Producer) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	producer = p
+}
+
+// ProduceExecutor produces transformed messages to a topic made from a template
+type ProduceExecutor struct {
+	producer Producer
+	topic    *messageTemplate
+	key      *messageTemplate
+	fields   []string
+	renames  [][2]string
+}
+
+func init() {
+	Register(ProduceTask, Definition{
+		NewConfig: func() interface{} {
+			return &utils.ProduceConfig{}
+		},
+		New: func(config interface{}) (Executor, error) {
+			registryMutex.RLock()
+			p := producer
+			registryMutex.RUnlock()
+			return NewProduceExecutor(config.(*utils.ProduceConfig), p)
+		},
+	})
+}
+
+// NewProduceExecutor creates a new produce executor
+func NewProduceExecutor(config *utils.ProduceConfig, producer Producer) (*ProduceExecutor, error) {
+	if producer == nil {
+		return nil, errors.New("no producer for produce task")
+	}
+	if config.Topic == "" {
+		return nil, errors.New("produce topic is required")
+	}
+	t := &ProduceExecutor{producer: producer}
+	var err error
+	if t.topic, err = compileTemplate(config.Topic); err != nil {
+		return nil, fmt.Errorf("invalid produce topic: %v", err)
+	}
+	if config.Key != "" {
+		if t.key, err = compileTemplate(config.Key); err != nil {
+			return nil, fmt.Errorf("invalid produce key: %v", err)
+		}
+	}
+	for _, f := range config.Fields {
+		t.fields = append(t.fields, escapePath(f))
+	}
+	// renames are applied in the order of their source paths, so the result doesn't depend on map iteration
+	from := make([]string, 0, len(config.Rename))
+	for k := range config.Rename {
+		from = append(from, k)
+	}
+	sort.Strings(from)
+	for _, k := range from {
+		t.renames = append(t.renames, [2]string{escapePath(k), escapePath(config.Rename[k])})
+	}
+	return t, nil
+}
+
+// Execute produces the transformed message to its topic
+func (t *ProduceExecutor) Execute(message []byte) error {
+	topic := t.topic.render(message)
+	if topic == "" {
+		return &ExecuteError{Err: errors.New("empty produce topic"), Attempts: 1, Permanent: true}
+	}
+	value, err := t.transform(message)
+	if err != nil {
+		return &ExecuteError{Err: err, Attempts: 1, Permanent: true}
+	}
+	var key []byte
+	if t.key != nil {
+		key = []byte(t.key.render(message))
+	}
+	if err := t.producer.Produce(topic, key, value); err != nil {
+		return err
+	}
+	log.WithField("topic", topic).Debug("message produced")
+	return nil
+}
+
+// transform keeps only fields if they are set, then renames fields
+func (t *ProduceExecutor) transform(message []byte) ([]byte, error) {
+	if !gjson.ValidBytes(message) {
+		return nil, errors.New("invalid json message")
+	}
+	value := message
+	var err error
+	if len(t.fields) > 0 {
+		value = []byte("{}")
+		for _, f := range t.fields {
+			r := gjson.GetBytes(message, f)
+			if !r.Exists() {
+				continue
+			}
+			if value, err = sjson.SetRawBytes(value, f, []byte(r.Raw)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, r := range t.renames {
+		v := gjson.GetBytes(value, r[0])
+		if !v.Exists() {
+			continue
+		}
+		if value, err = sjson.DeleteBytes(value, r[0]); err != nil {
+			return nil, err
+		}
+		if value, err = sjson.SetRawBytes(value, r[1], []byte(v.Raw)); err != nil {
+			return nil, err
+		}
+	}
+	return value, nil
+}
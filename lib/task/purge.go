@@ -2,60 +2,143 @@ package task
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/cloudflare/cloudflare-go"
+	"github.com/mudkipme/timburr/metrics"
 	"github.com/mudkipme/timburr/utils"
 	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/sjson"
 )
 
 // PurgeExecutor purges the front-end cache by URLs
 type PurgeExecutor struct {
-	expiry   time.Duration
-	entries  []utils.PurgeEntryConfig
-	client   *http.Client
-	cfAPI    *cloudflare.API
-	cfZoneID string
+	expiry       time.Duration
+	entries      []utils.PurgeEntryConfig
+	client       *http.Client
+	cf           *cfBatcher
+	reboundTopic string
+	producer     Producer
+	dedupe       *dedupeCache
+	rules        []purgeRules
+	// retryAttempts and retryBackoff retry failed purges of required entries
+	retryAttempts int
+	retryBackoff  time.Duration
+	// trailing are purges skipped by dedupe, which are sent together at the end of the dedupe window
+	trailingMutex sync.Mutex
+	trailing      []requestOptions
+	trailingTimer *time.Timer
 }
 
 type requestOptions struct {
 	method  string
 	url     string
 	headers map[string]string
+	entry   *utils.PurgeEntryConfig
 }
 
-// DefaultPurgeExecutor creates a purge executor based on config.yml
-func DefaultPurgeExecutor() *PurgeExecutor {
-	var cfAPI *cloudflare.API
-	var err error
-	if utils.Config.Purge.CFToken != "" {
-		cfAPI, err = cloudflare.NewWithAPIToken(utils.Config.Purge.CFToken)
+// reboundField is added to messages produced to the rebound topic
+const reboundField = "timburr_rebound"
+
+// rebound is a delayed second purge of entries with the same rebound delay
+type rebound struct {
+	Delay int64     `json:"delay"`
+	Due   time.Time `json:"due"`
+}
+
+func init() {
+	Register(PurgeTask, Definition{
+		NewConfig: func() interface{} {
+			config := utils.CurrentConfig().Purge
+			return &config
+		},
+		New: func(config interface{}) (Executor, error) {
+			registryMutex.RLock()
+			p := producer
+			registryMutex.RUnlock()
+			return NewPurgeExecutor(config.(*utils.PurgeConfig), p)
+		},
+	})
+}
+
+// NewPurgeExecutor creates a new purge executor, the producer is only needed by rebound purges
+func NewPurgeExecutor(config *utils.PurgeConfig, producer Producer) (*PurgeExecutor, error) {
+	for _, entry := range config.Entries {
+		switch strings.ToLower(entry.CFPurgeBy) {
+		case "", CFPurgeFiles, CFPurgeTags, CFPurgePrefixes:
+		default:
+			return nil, fmt.Errorf("invalid cfPurgeBy of %v: %v", entry.Host, entry.CFPurgeBy)
+		}
+		// cloudflare purges are sent in batches later, so whether they succeed is unknown to the message
+		if entry.Required && strings.ToLower(entry.Method) == "cloudflare" {
+			return nil, fmt.Errorf("required is not supported by the cloudflare method of %v", entry.Host)
+		}
+		if entry.ReboundDelay > 0 && config.ReboundTopic == "" {
+			return nil, fmt.Errorf("reboundTopic is required for reboundDelay of %v", entry.Host)
+		}
+	}
+	if config.ReboundTopic != "" && producer == nil {
+		return nil, errors.New("no producer for rebound purges")
+	}
+
+	rules := []purgeRules{}
+	for _, entry := range config.Entries {
+		r, err := compilePurgeRules(entry)
 		if err != nil {
-			log.WithError(err).Error("cloudflare api invalid")
+			return nil, err
 		}
+		rules = append(rules, r)
 	}
-	return NewPurgeExecutor(
-		time.Millisecond*time.Duration(utils.Config.Purge.Expiry),
-		utils.Config.Purge.Entries,
-		cfAPI,
-		utils.Config.Purge.CFZoneID,
-	)
-}
 
-// NewPurgeExecutor creates a new purge executor
-func NewPurgeExecutor(expiry time.Duration, entries []utils.PurgeEntryConfig, cfAPI *cloudflare.API, cfZoneID string) *PurgeExecutor {
+	var cf *cfBatcher
+	if config.CFToken != "" {
+		cfAPI, err := newCFAPI(config.CFToken)
+		if err != nil {
+			return nil, err
+		}
+		cfBatchWindow := time.Millisecond * time.Duration(config.CFBatchWindow)
+		if cfBatchWindow <= 0 {
+			cfBatchWindow = time.Second
+		}
+		cf = newCFBatcher(cfAPI, config.CFZoneID, cfBatchWindow)
+	}
+	var dedupe *dedupeCache
+	if config.DedupeWindow > 0 {
+		size := config.DedupeSize
+		if size <= 0 {
+			size = 10000
+		}
+		dedupe = newDedupeCache(time.Millisecond*time.Duration(config.DedupeWindow), size)
+	}
+	retryAttempts := config.RetryAttempts
+	if retryAttempts <= 0 {
+		retryAttempts = 3
+	}
+	retryBackoff := time.Duration(config.RetryBackoff) * time.Millisecond
+	if retryBackoff <= 0 {
+		retryBackoff = time.Second
+	}
 	return &PurgeExecutor{
-		expiry:  expiry,
-		entries: entries,
+		expiry:  time.Millisecond * time.Duration(config.Expiry),
+		entries: config.Entries,
 		client: &http.Client{
 			Timeout: time.Second * 2,
 		},
-		cfAPI:    cfAPI,
-		cfZoneID: cfZoneID,
-	}
+		cf:            cf,
+		reboundTopic:  config.ReboundTopic,
+		producer:      producer,
+		dedupe:        dedupe,
+		rules:         rules,
+		retryAttempts: retryAttempts,
+		retryBackoff:  retryBackoff,
+	}, nil
 }
 
 // Execute sends the corresponding PURGE requests from a kafka message
@@ -65,6 +148,7 @@ func (t *PurgeExecutor) Execute(message []byte) error {
 			URI  string    `json:"uri"`
 			Date time.Time `json:"dt"`
 		} `json:"meta"`
+		Rebound *rebound `json:"timburr_rebound"`
 	}
 	var msg purgeData
 	err := json.Unmarshal(message, &msg)
@@ -78,15 +162,78 @@ func (t *PurgeExecutor) Execute(message []byte) error {
 		return nil
 	}
 
-	t.handlePurge(msg.Meta.URI)
+	if msg.Rebound != nil {
+		// messages in the rebound topic are in the order of due time, so waiting here delays the following ones as well,
+		// which is why the rebound topic is consumed by a dedicated rule
+		if wait := time.Until(msg.Rebound.Due); wait > 0 {
+			time.Sleep(wait)
+		}
+		return t.handlePurge(msg.Meta.URI, msg.Rebound.Delay)
+	}
+
+	if err := t.handlePurge(msg.Meta.URI, 0); err != nil {
+		return err
+	}
+	return t.scheduleRebounds(message, msg.Meta.URI)
+}
+
+// Close sends trailing purges of the dedupe window and cloudflare purges still waiting for their batch
+func (t *PurgeExecutor) Close() error {
+	t.flushTrailing()
+	if t.cf != nil {
+		t.cf.close(cfCloseTimeout)
+	}
+	return nil
+}
+
+// scheduleRebounds produces a message to the rebound topic for each rebound delay of matched entries
+func (t *PurgeExecutor) scheduleRebounds(message []byte, item string) error {
+	u, err := url.Parse(item)
+	if err != nil || t.reboundTopic == "" {
+		return nil
+	}
+	delays := make(map[int64]bool)
+	for i, entry := range t.entries {
+		if t.matchEntry(i, u, 0) && entry.ReboundDelay > 0 && !delays[entry.ReboundDelay] {
+			delays[entry.ReboundDelay] = true
+			r := rebound{
+				Delay: entry.ReboundDelay,
+				Due:   time.Now().Add(time.Millisecond * time.Duration(entry.ReboundDelay)),
+			}
+			rb, err := json.Marshal(r)
+			if err != nil {
+				return err
+			}
+			value, err := sjson.SetRawBytes(message, reboundField, rb)
+			if err != nil {
+				return err
+			}
+			if err := t.producer.Produce(t.reboundTopic, nil, value); err != nil {
+				return fmt.Errorf("produce rebound purge failed: %v", err)
+			}
+		}
+	}
 	return nil
 }
 
-func (t *PurgeExecutor) handlePurge(item string) {
+// matchEntry reports whether an entry purges a url by its host and pathRegex,
+// only entries with the rebound delay match if it's not zero
+func (t *PurgeExecutor) matchEntry(i int, u *url.URL, reboundDelay int64) bool {
+	entry := &t.entries[i]
+	if entry.Host != u.Host || (reboundDelay > 0 && entry.ReboundDelay != reboundDelay) {
+		return false
+	}
+	pathRegex := t.rules[i].pathRegex
+	return pathRegex == nil || pathRegex.MatchString(u.Path)
+}
+
+// handlePurge purges a url by every matched entry, or only entries with the rebound delay if it's not zero,
+// a PurgeError is returned if purges of required entries still failed after retries
+func (t *PurgeExecutor) handlePurge(item string, reboundDelay int64) error {
 	ros := []requestOptions{}
 	u, err := url.Parse(item)
 	if err != nil {
-		return
+		return nil
 	}
 	queries := strings.Split(u.RawQuery, "&")
 	lastQuery := ""
@@ -99,10 +246,17 @@ func (t *PurgeExecutor) handlePurge(item string) {
 		firstPath = pathComponents[1]
 	}
 
-	for _, entry := range t.entries {
-		if entry.Host != u.Host {
+	for i := range t.entries {
+		if !t.matchEntry(i, u, reboundDelay) {
 			continue
 		}
+		entry := &t.entries[i]
+		rules := t.rules[i]
+		articlePath := entry.ArticlePath
+		if articlePath == "" {
+			articlePath = "/wiki/"
+		}
+		title := purgeTitle(u, articlePath)
 		variants := make(map[string]bool)
 		variants[""] = true
 		for _, variant := range entry.Variants {
@@ -115,43 +269,302 @@ func (t *PurgeExecutor) handlePurge(item string) {
 					(firstPath != "" && variants[firstPath])) {
 					continue
 				}
-				ros = append(ros, requestOptions{
-					method:  entry.Method,
-					url:     strings.ReplaceAll(strings.ReplaceAll(uri, "#url#", u.RequestURI()), "#variants#", variant),
-					headers: entry.Headers,
-				})
-
-				if firstPath == "wiki" && variant != "" {
-					ros = append(ros, requestOptions{
-						method:  entry.Method,
-						url:     strings.ReplaceAll(strings.ReplaceAll(strings.ReplaceAll(uri, "#url#", u.RequestURI()), "#variants#", ""), "/wiki/", "/"+variant+"/"),
-						headers: entry.Headers,
-					})
+				replacer := purgeReplacer(u, title, variant)
+				ros = append(ros, rules.request(entry, replacer.Replace(uri), replacer))
+
+				// a page of a variant is also cached as /<variant>/<title>
+				if strings.HasPrefix(u.Path, articlePath) && variant != "" {
+					replacer = purgeReplacer(u, title, "")
+					if purgeURL, ok := variantURL(replacer.Replace(uri), articlePath, variant); ok {
+						ros = append(ros, rules.request(entry, purgeURL, replacer))
+					}
 				}
 			}
 		}
 	}
 
 	ros = uniq(ros)
-	ch := make(chan bool)
+	// rebound purges are meant to purge the same urls again
+	if t.dedupe != nil && reboundDelay == 0 {
+		ros = t.deduplicate(ros)
+	}
+	return t.retryPurge(item, ros)
+}
+
+// retryPurge sends purges, and retries only the failed and timed out purges of required entries
+// with exponential backoff until they succeed or run out of attempts
+func (t *PurgeExecutor) retryPurge(item string, ros []requestOptions) error {
+	wait := t.retryBackoff
+	var err error
+	for attempt := 1; attempt <= t.retryAttempts; attempt++ {
+		var result *PurgeResult
+		result, err = t.purge(ros)
+		result.log(log.WithField("url", item).WithField("attempt", attempt))
+		var perr *PurgeError
+		if !errors.As(err, &perr) {
+			return nil
+		}
+		if attempt < t.retryAttempts {
+			metrics.ExecuteRetries.WithLabelValues(PurgeTask).Inc()
+			time.Sleep(wait)
+			wait *= 2
+			ros = perr.requests
+		}
+	}
+	return &ExecuteError{Err: err, Attempts: t.retryAttempts}
+}
+
+// defaultPurgeConcurrency is the concurrency of purge entries without concurrency
+const defaultPurgeConcurrency = 10
+
+// purgeOutcome is the outcome of a purge request
+type purgeOutcome int
+
+const (
+	purgeSucceeded purgeOutcome = iota
+	purgeNotFound
+	// purgeQueued is a cloudflare purge to be sent in a batch later
+	purgeQueued
+	purgeTimedOut
+	purgeFailed
+)
+
+func (o purgeOutcome) String() string {
+	switch o {
+	case purgeSucceeded:
+		return "success"
+	case purgeNotFound:
+		return "not_found"
+	case purgeQueued:
+		return "queued"
+	case purgeTimedOut:
+		return "timeout"
+	}
+	return "failure"
+}
+
+// PurgeResult lists purged urls by the outcome of their requests
+type PurgeResult struct {
+	Succeeded []string
+	NotFound  []string
+	Queued    []string
+	TimedOut  []string
+	Failed    []string
+}
+
+func (r *PurgeResult) add(url string, outcome purgeOutcome) {
+	switch outcome {
+	case purgeSucceeded:
+		r.Succeeded = append(r.Succeeded, url)
+	case purgeNotFound:
+		r.NotFound = append(r.NotFound, url)
+	case purgeQueued:
+		r.Queued = append(r.Queued, url)
+	case purgeTimedOut:
+		r.TimedOut = append(r.TimedOut, url)
+	default:
+		r.Failed = append(r.Failed, url)
+	}
+}
+
+// log logs the counts of outcomes, and the failed and timed out urls at the warning level
+func (r *PurgeResult) log(logger *log.Entry) {
+	logger = logger.WithField("succeeded", len(r.Succeeded)).
+		WithField("notFound", len(r.NotFound)).
+		WithField("queued", len(r.Queued))
+	if len(r.TimedOut) > 0 || len(r.Failed) > 0 {
+		logger.WithField("timedOut", r.TimedOut).WithField("failed", r.Failed).Warn("purge finished with failures")
+	} else {
+		logger.Debug("purge finished")
+	}
+}
+
+// PurgeError is returned when purges of required entries failed or timed out
+type PurgeError struct {
+	Failed   []string
+	TimedOut []string
+	// requests are the failed and timed out purges to retry
+	requests []requestOptions
+}
+
+func (e *PurgeError) Error() string {
+	parts := []string{}
+	if len(e.Failed) > 0 {
+		parts = append(parts, "failed: "+strings.Join(e.Failed, ", "))
+	}
+	if len(e.TimedOut) > 0 {
+		parts = append(parts, "timed out: "+strings.Join(e.TimedOut, ", "))
+	}
+	return "purge of required entries " + strings.Join(parts, "; ")
+}
+
+// purge sends requests by workers of each entry, a PurgeError is returned if requests of required entries failed
+func (t *PurgeExecutor) purge(ros []requestOptions) (*PurgeResult, error) {
+	groups := make(map[*utils.PurgeEntryConfig][]requestOptions)
 	for _, ro := range ros {
-		go t.doRequest(ro.method, ro.url, ro.headers, ch)
+		groups[ro.entry] = append(groups[ro.entry], ro)
 	}
-	for range ros {
-		<-ch
+
+	// htcp purges of a message share sockets
+	htcp := newHTCPSender()
+	defer htcp.close()
+
+	result := &PurgeResult{}
+	perr := &PurgeError{}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for entry, group := range groups {
+		jobs := make(chan requestOptions, len(group))
+		for _, ro := range group {
+			jobs <- ro
+		}
+		close(jobs)
+
+		workers := entry.Concurrency
+		if workers <= 0 {
+			workers = defaultPurgeConcurrency
+		}
+		if workers > len(group) {
+			workers = len(group)
+		}
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for ro := range jobs {
+					outcome := t.doRequest(ro, htcp)
+					metrics.PurgeRequests.WithLabelValues(strings.ToLower(ro.method), outcome.String()).Inc()
+					if t.dedupe != nil && outcome != purgeTimedOut && outcome != purgeFailed {
+						t.dedupe.record(ro.key())
+					}
+					mutex.Lock()
+					result.add(ro.url, outcome)
+					if ro.entry.Required && outcome == purgeFailed {
+						perr.Failed = append(perr.Failed, ro.url)
+						perr.requests = append(perr.requests, ro)
+					} else if ro.entry.Required && outcome == purgeTimedOut {
+						perr.TimedOut = append(perr.TimedOut, ro.url)
+						perr.requests = append(perr.requests, ro)
+					}
+					mutex.Unlock()
+				}
+			}()
+		}
 	}
+	wg.Wait()
+
+	if len(perr.Failed) > 0 || len(perr.TimedOut) > 0 {
+		return result, perr
+	}
+	return result, nil
 }
 
-func (t *PurgeExecutor) doRequest(method, url string, headers map[string]string, ch chan bool) {
-	if strings.ToLower(method) == "cloudflare" {
-		t.doCloudFlarePurge(url, ch)
-		return
+// purgeRules are the compiled path condition and rewrites of a purge entry
+type purgeRules struct {
+	pathRegex *regexp.Regexp
+	rewrites  []purgeRewrite
+}
+
+type purgeRewrite struct {
+	match   *regexp.Regexp
+	replace string
+}
+
+func compilePurgeRules(entry utils.PurgeEntryConfig) (purgeRules, error) {
+	rules := purgeRules{}
+	var err error
+	if entry.PathRegex != "" {
+		if rules.pathRegex, err = regexp.Compile(entry.PathRegex); err != nil {
+			return rules, fmt.Errorf("invalid pathRegex of %v: %v", entry.Host, err)
+		}
+	}
+	for _, r := range entry.Rewrites {
+		match, err := regexp.Compile(r.Match)
+		if err != nil {
+			return rules, fmt.Errorf("invalid rewrite of %v: %v", entry.Host, err)
+		}
+		rules.rewrites = append(rules.rewrites, purgeRewrite{match: match, replace: r.Replace})
+	}
+	return rules, nil
+}
+
+// request applies rewrites to a purge url, and replaces placeholders in headers
+func (rules purgeRules) request(entry *utils.PurgeEntryConfig, purgeURL string, replacer *strings.Replacer) requestOptions {
+	for _, r := range rules.rewrites {
+		purgeURL = r.match.ReplaceAllString(purgeURL, r.replace)
+	}
+	headers := make(map[string]string, len(entry.Headers))
+	for k, v := range entry.Headers {
+		headers[k] = replacer.Replace(v)
+	}
+	return requestOptions{
+		method:  entry.Method,
+		url:     purgeURL,
+		headers: headers,
+		entry:   entry,
+	}
+}
+
+// purgeReplacer replaces placeholders in uris and headers of purge entries
+func purgeReplacer(u *url.URL, title string, variant string) *strings.Replacer {
+	query := ""
+	if u.RawQuery != "" {
+		query = "?" + u.RawQuery
+	}
+	return strings.NewReplacer(
+		"#url#", u.RequestURI(),
+		"#scheme#", u.Scheme,
+		"#host#", u.Host,
+		"#path#", u.EscapedPath(),
+		"#query#", query,
+		"#title#", title,
+		"#variants#", variant,
+	)
+}
+
+// variantURL replaces the leading articlePath in the path of a purge url with /<variant>/,
+// the encoding of the rest of the url is kept
+func variantURL(purgeURL string, articlePath string, variant string) (string, bool) {
+	pu, err := url.Parse(purgeURL)
+	if err != nil {
+		return "", false
+	}
+	escaped := pu.EscapedPath()
+	if !strings.HasPrefix(escaped, articlePath) {
+		return "", false
+	}
+	rawPath := "/" + variant + "/" + strings.TrimPrefix(escaped, articlePath)
+	path, err := url.PathUnescape(rawPath)
+	if err != nil {
+		return "", false
+	}
+	pu.Path, pu.RawPath = path, rawPath
+	return pu.String(), true
+}
+
+// purgeTitle returns the decoded title of a page url like /wiki/<title> or /index.php?title=<title>
+func purgeTitle(u *url.URL, articlePath string) string {
+	if title := u.Query().Get("title"); title != "" {
+		return title
+	}
+	if strings.HasPrefix(u.Path, articlePath) {
+		return strings.TrimPrefix(u.Path, articlePath)
+	}
+	return ""
+}
+
+func (t *PurgeExecutor) doRequest(ro requestOptions, htcp *htcpSender) purgeOutcome {
+	method, url, headers := ro.method, ro.url, ro.headers
+	switch strings.ToLower(method) {
+	case "cloudflare":
+		return t.doCloudFlarePurge(url, ro.entry)
+	case "htcp":
+		return t.doHTCPPurge(url, ro.entry, htcp)
 	}
 	req, err := http.NewRequest(method, url, nil)
 	if err != nil {
 		log.WithError(err).WithField("url", url).Warn("failed to send purge request")
-		ch <- false
-		return
+		return purgeFailed
 	}
 	for k, v := range headers {
 		req.Header.Set(k, v)
@@ -162,42 +575,109 @@ func (t *PurgeExecutor) doRequest(method, url string, headers map[string]string,
 	response, err := t.client.Do(req)
 	if err != nil {
 		log.WithError(err).WithField("url", url).Warn("failed to send purge request")
-		ch <- false
-		return
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			return purgeTimedOut
+		}
+		return purgeFailed
 	}
 	response.Body.Close()
-	if response.StatusCode >= 200 && response.StatusCode < 300 {
+	switch {
+	case response.StatusCode >= 200 && response.StatusCode < 300:
 		log.WithField("url", url).Info("purge success")
-	} else if response.StatusCode != http.StatusNotFound && response.StatusCode >= 300 {
-		log.WithField("statusCode", response.StatusCode).WithField("url", url).Warn("failed to send purge request")
+		return purgeSucceeded
+	case response.StatusCode == http.StatusNotFound:
+		// the url is not cached
+		return purgeNotFound
 	}
-	ch <- true
+	log.WithField("statusCode", response.StatusCode).WithField("url", url).Warn("failed to send purge request")
+	return purgeFailed
 }
 
-func (t *PurgeExecutor) doCloudFlarePurge(url string, ch chan bool) {
-	if t.cfAPI == nil {
+// doCloudFlarePurge queues a url, or a tag or prefix made from uris of the entry, to purge in batches
+func (t *PurgeExecutor) doCloudFlarePurge(url string, entry *utils.PurgeEntryConfig) purgeOutcome {
+	if t.cf == nil {
 		log.WithField("url", url).Warn("failed to purge cloudflare cache")
-		ch <- false
-		return
+		return purgeFailed
 	}
-	resp, err := t.cfAPI.PurgeCache(t.cfZoneID, cloudflare.PurgeCacheRequest{
-		Files: []string{url},
-	})
-	if err != nil {
-		log.WithError(err).WithField("url", url).Warn("failed to purge cloudflare cache")
-		ch <- false
+	mode := strings.ToLower(entry.CFPurgeBy)
+	if mode == "" {
+		mode = CFPurgeFiles
+	}
+	t.cf.add(mode, url)
+	return purgeQueued
+}
+
+func (t *PurgeExecutor) doHTCPPurge(url string, entry *utils.PurgeEntryConfig, htcp *htcpSender) purgeOutcome {
+	ttl := entry.HTCPTTL
+	if ttl <= 0 {
+		ttl = 1
+	}
+	if err := htcp.send(url, entry.HTCPAddresses, ttl); err != nil {
+		log.WithError(err).WithField("url", url).Warn("failed to send htcp purge")
+		return purgeFailed
+	}
+	log.WithField("url", url).Info("purge success")
+	return purgeSucceeded
+}
+
+// deduplicate skips purges sent within the dedupe window, a skipped purge is sent again once at the end of the window,
+// so changes made within the window are purged as well
+func (t *PurgeExecutor) deduplicate(input []requestOptions) []requestOptions {
+	res := make([]requestOptions, 0, len(input))
+	for _, ro := range input {
+		recent, rest := t.dedupe.check(ro.key())
+		if !recent {
+			res = append(res, ro)
+			continue
+		}
+		metrics.PurgesDeduplicated.WithLabelValues(strings.ToLower(ro.method)).Inc()
+		if rest > 0 {
+			t.addTrailing(ro)
+		}
+	}
+	return res
+}
+
+// addTrailing queues a purge skipped by dedupe, queued purges are sent together a dedupe window after the first of them
+func (t *PurgeExecutor) addTrailing(ro requestOptions) {
+	t.trailingMutex.Lock()
+	defer t.trailingMutex.Unlock()
+	t.trailing = append(t.trailing, ro)
+	if t.trailingTimer == nil {
+		t.trailingTimer = time.AfterFunc(t.dedupe.window, t.flushTrailing)
+	}
+}
+
+// flushTrailing sends queued trailing purges with the concurrency of their entries
+func (t *PurgeExecutor) flushTrailing() {
+	t.trailingMutex.Lock()
+	ros := t.trailing
+	t.trailing = nil
+	if t.trailingTimer != nil {
+		t.trailingTimer.Stop()
+		t.trailingTimer = nil
+	}
+	t.trailingMutex.Unlock()
+	if len(ros) == 0 {
 		return
 	}
-	log.WithField("url", url).WithField("response", resp).Info("purge success")
-	ch <- true
+	result, _ := t.purge(uniq(ros))
+	result.log(log.WithField("trailing", len(ros)))
+}
+
+// key identifies the purge of a url by a method
+func (ro requestOptions) key() string {
+	return strings.ToLower(ro.method) + " " + ro.url
 }
 
 func uniq(input []requestOptions) (res []requestOptions) {
 	res = make([]requestOptions, 0, len(input))
 	seen := make(map[string]bool)
 	for _, val := range input {
-		if _, ok := seen[val.url]; !ok {
-			seen[val.url] = true
+		key := val.key()
+		if _, ok := seen[key]; !ok {
+			seen[key] = true
 			res = append(res, val)
 		}
 	}
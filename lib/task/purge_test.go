@@ -0,0 +1,380 @@
+package task
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mudkipme/timburr/utils"
+	"github.com/tidwall/gjson"
+)
+
+type fakeProducer struct {
+	mutex    sync.Mutex
+	messages []string
+}
+
+func (p *fakeProducer) Produce(topic string, key []byte, value []byte) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.messages = append(p.messages, string(value))
+	return nil
+}
+
+// purgeServer records purged urls and the most purges at the same time, and fails purges while failing is set
+type purgeServer struct {
+	*httptest.Server
+	mutex     sync.Mutex
+	purged    []string
+	failing   bool
+	active    int
+	maxActive int
+}
+
+func newPurgeServer() *purgeServer {
+	s := &purgeServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		s.purged = append(s.purged, r.URL.RequestURI())
+		if s.active++; s.active > s.maxActive {
+			s.maxActive = s.active
+		}
+		failing := s.failing
+		s.mutex.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+		s.mutex.Lock()
+		s.active--
+		s.mutex.Unlock()
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	return s
+}
+
+func (s *purgeServer) reset(failing bool) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	purged := s.purged
+	s.purged = nil
+	s.failing = failing
+	return purged
+}
+
+func purgeMessage(uri string) []byte {
+	return []byte(fmt.Sprintf(`{"meta":{"uri":%q,"dt":%q}}`, uri, time.Now().Format(time.RFC3339)))
+}
+
+func TestPurgeRebound(t *testing.T) {
+	s := newPurgeServer()
+	defer s.Close()
+	producer := &fakeProducer{}
+	executor, err := NewPurgeExecutor(&utils.PurgeConfig{
+		Expiry:       60000,
+		ReboundTopic: "cdn-url-purges-rebound",
+		Entries: []utils.PurgeEntryConfig{{
+			Host:         "wiki.52poke.com",
+			Method:       "PURGE",
+			URIs:         []string{s.URL + "#url#"},
+			PathRegex:    "^/wiki/",
+			ReboundDelay: 1000,
+			Required:     true,
+		}},
+		RetryAttempts: 2,
+		RetryBackoff:  1,
+	}, producer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// urls not matching pathRegex are neither purged nor rebounded
+	if err := executor.Execute(purgeMessage("https://wiki.52poke.com/index.php?title=Pikachu")); err != nil {
+		t.Fatal(err)
+	}
+	if purged := s.reset(true); len(purged) != 0 || len(producer.messages) != 0 {
+		t.Errorf("purged %v and scheduled %v rebounds, want none", purged, len(producer.messages))
+	}
+
+	// a failed purge is not rebounded
+	if err := executor.Execute(purgeMessage("https://wiki.52poke.com/wiki/Pikachu")); err == nil {
+		t.Error("a failed required purge succeeded")
+	}
+	if s.reset(false); len(producer.messages) != 0 {
+		t.Errorf("scheduled %v rebounds of a failed purge, want none", len(producer.messages))
+	}
+
+	if err := executor.Execute(purgeMessage("https://wiki.52poke.com/wiki/Pikachu")); err != nil {
+		t.Fatal(err)
+	}
+	if purged := s.reset(false); len(purged) != 1 || purged[0] != "/wiki/Pikachu" {
+		t.Errorf("purged %v, want [/wiki/Pikachu]", purged)
+	}
+	if len(producer.messages) != 1 {
+		t.Fatalf("scheduled %v rebounds, want 1", len(producer.messages))
+	}
+	rebound := producer.messages[0]
+	if delay := gjson.Get(rebound, reboundField+".delay").Int(); delay != 1000 {
+		t.Errorf("rebound delay is %v, want 1000", delay)
+	}
+
+	// the rebound purges the url again once it's due
+	start := time.Now()
+	if err := executor.Execute([]byte(rebound)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("rebound purged after %v, want 1s", elapsed)
+	}
+	if purged := s.reset(false); len(purged) != 1 || len(producer.messages) != 1 {
+		t.Errorf("rebound purged %v and scheduled %v rebounds, want 1 purge and no more rebounds", purged, len(producer.messages)-1)
+	}
+}
+
+func TestPurgeRetry(t *testing.T) {
+	var mutex sync.Mutex
+	purged := []string{}
+	// failures is the number of times each path fails before it succeeds
+	failures := map[string]int{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		purged = append(purged, r.URL.Path)
+		if failures[r.URL.Path] > 0 {
+			failures[r.URL.Path]--
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer s.Close()
+	executor, err := NewPurgeExecutor(&utils.PurgeConfig{
+		Expiry: 60000,
+		Entries: []utils.PurgeEntryConfig{{
+			Host:     "wiki.52poke.com",
+			Method:   "PURGE",
+			URIs:     []string{s.URL + "/required/#title#", s.URL + "/stable/#title#"},
+			Required: true,
+		}, {
+			Host:   "wiki.52poke.com",
+			Method: "PURGE",
+			URIs:   []string{s.URL + "/optional/#title#"},
+		}},
+		RetryAttempts: 3,
+		RetryBackoff:  1,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		failures int
+		attempts int
+		want     []string
+	}{
+		// only the failed purge of the required entry is sent again, the optional one is only sent once
+		{"recovered", 2, 0, []string{"/optional/Pikachu", "/required/Pikachu", "/required/Pikachu", "/required/Pikachu", "/stable/Pikachu"}},
+		{"exhausted", 5, 3, []string{"/optional/Pikachu", "/required/Pikachu", "/required/Pikachu", "/required/Pikachu", "/stable/Pikachu"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutex.Lock()
+			purged = nil
+			failures = map[string]int{"/required/Pikachu": tt.failures, "/optional/Pikachu": 5}
+			mutex.Unlock()
+
+			err := executor.Execute(purgeMessage("https://wiki.52poke.com/wiki/Pikachu"))
+			if tt.attempts == 0 && err != nil {
+				t.Fatal(err)
+			}
+			if tt.attempts > 0 {
+				var ee *ExecuteError
+				if !errors.As(err, &ee) || ee.Attempts != tt.attempts {
+					t.Fatalf("error is %v, want an ExecuteError of %v attempts", err, tt.attempts)
+				}
+				var perr *PurgeError
+				if !errors.As(ee.Err, &perr) || len(perr.Failed) != 1 || perr.Failed[0] != s.URL+"/required/Pikachu" {
+					t.Errorf("error is %v, want a PurgeError of the required url", ee.Err)
+				}
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			sort.Strings(purged)
+			if !reflect.DeepEqual(purged, tt.want) {
+				t.Errorf("purged %v, want %v", purged, tt.want)
+			}
+		})
+	}
+}
+
+func TestPurgeDedupe(t *testing.T) {
+	s := newPurgeServer()
+	defer s.Close()
+	executor, err := NewPurgeExecutor(&utils.PurgeConfig{
+		Expiry:       60000,
+		DedupeWindow: 300,
+		Entries: []utils.PurgeEntryConfig{{
+			Host:   "wiki.52poke.com",
+			Method: "PURGE",
+			URIs:   []string{s.URL + "#url#"},
+		}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := purgeMessage("https://wiki.52poke.com/wiki/Pikachu")
+
+	// a failed purge is not remembered, so it's sent again
+	s.reset(true)
+	executor.Execute(message)
+	executor.Execute(message)
+	if purged := s.reset(false); len(purged) != 2 {
+		t.Errorf("purged %v after a failure, want the url purged again", purged)
+	}
+
+	// purges within the window are merged into one trailing purge at the end of the window
+	executor.Execute(message)
+	executor.Execute(message)
+	executor.Execute(message)
+	if purged := s.reset(false); len(purged) != 1 {
+		t.Errorf("purged %v within the window, want 1", purged)
+	}
+	time.Sleep(400 * time.Millisecond)
+	if purged := s.reset(false); len(purged) != 1 {
+		t.Errorf("purged %v at the end of the window, want 1 trailing purge", purged)
+	}
+
+	// the trailing purge starts a new window
+	executor.Execute(message)
+	time.Sleep(400 * time.Millisecond)
+	if purged := s.reset(false); len(purged) != 1 {
+		t.Errorf("purged %v after the trailing purge, want 1", purged)
+	}
+}
+
+func TestVariantURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"http://127.0.0.1/wiki/Pikachu", "http://127.0.0.1/zh-hans/Pikachu"},
+		{"http://127.0.0.1/wiki/Pikachu?action=history", "http://127.0.0.1/zh-hans/Pikachu?action=history"},
+		{"http://127.0.0.1/wiki/%E7%9A%AE%E5%8D%A1%E4%B8%98", "http://127.0.0.1/zh-hans/%E7%9A%AE%E5%8D%A1%E4%B8%98"},
+		{"http://127.0.0.1/wiki/AC/DC%2F1", "http://127.0.0.1/zh-hans/AC/DC%2F1"},
+		{"http://127.0.0.1/wiki/Help:/wiki/", "http://127.0.0.1/zh-hans/Help:/wiki/"},
+		{"http://127.0.0.1/wiki/Pikachu?returnto=/wiki/Raichu", "http://127.0.0.1/zh-hans/Pikachu?returnto=/wiki/Raichu"},
+		{"http://wiki.52poke.com/wiki/Pikachu", "http://wiki.52poke.com/zh-hans/Pikachu"},
+		{"http://127.0.0.1/index.php?title=Pikachu&returnto=/wiki/Raichu", ""},
+		{"http://127.0.0.1/webp-cache/wiki/Pikachu", ""},
+	}
+	for _, tt := range tests {
+		got, ok := variantURL(tt.url, "/wiki/", "zh-hans")
+		if ok != (tt.want != "") || got != tt.want {
+			t.Errorf("variantURL(%q) = %q, %v, want %q", tt.url, got, ok, tt.want)
+		}
+	}
+}
+
+func TestPurgeRequiredCloudflare(t *testing.T) {
+	_, err := NewPurgeExecutor(&utils.PurgeConfig{
+		CFToken:  "cf-token",
+		CFZoneID: "zone-id",
+		Entries: []utils.PurgeEntryConfig{{
+			Host:     "media.52poke.com",
+			Method:   "Cloudflare",
+			URIs:     []string{"https://media.52poke.com#url#"},
+			Required: true,
+		}},
+	}, nil)
+	if err == nil {
+		t.Error("a required cloudflare entry is accepted")
+	}
+}
+
+func TestPurgeCloudflareClose(t *testing.T) {
+	s := newCFServer(t)
+	defer s.Close()
+	executor, err := NewPurgeExecutor(&utils.PurgeConfig{
+		Expiry:        60000,
+		CFToken:       "cf-token",
+		CFZoneID:      "zone-id",
+		CFBatchWindow: 60000,
+		Entries: []utils.PurgeEntryConfig{{
+			Host:   "media.52poke.com",
+			Method: "Cloudflare",
+			URIs:   []string{"https://media.52poke.com#url#"},
+		}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	executor.cf.api.BaseURL = s.URL
+
+	// a cloudflare purge is only queued, and sent when the executor is closed
+	ro := requestOptions{method: "Cloudflare", url: "https://media.52poke.com/wiki/Pikachu.png", entry: &executor.entries[0]}
+	if outcome := executor.doRequest(ro, nil); outcome != purgeQueued {
+		t.Errorf("cloudflare purge outcome is %v, want queued", outcome)
+	}
+	if err := executor.Execute(purgeMessage("https://media.52poke.com/wiki/Raichu.png")); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.count(); n != 0 {
+		t.Fatalf("%v requests sent before the end of the window", n)
+	}
+	if err := Close(executor); err != nil {
+		t.Fatal(err)
+	}
+	if requests := s.wait(t, 1); len(requests[0].items) != 2 {
+		t.Errorf("purged %v on close, want both files", requests[0].items)
+	}
+}
+
+func TestPurgeTrailing(t *testing.T) {
+	s := newPurgeServer()
+	defer s.Close()
+	executor, err := NewPurgeExecutor(&utils.PurgeConfig{
+		Expiry:       60000,
+		DedupeWindow: 60000,
+		Entries: []utils.PurgeEntryConfig{{
+			Host:        "wiki.52poke.com",
+			Method:      "PURGE",
+			URIs:        []string{s.URL + "#url#"},
+			Concurrency: 2,
+		}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every url of a mass edit is purged again within the window
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 20; i++ {
+			if err := executor.Execute(purgeMessage(fmt.Sprintf("https://wiki.52poke.com/wiki/Page_%d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if purged := s.reset(false); len(purged) != 20 {
+		t.Errorf("purged %v urls within the window, want 20", len(purged))
+	}
+
+	// trailing purges are sent together when the executor is closed, with the concurrency of the entry
+	if err := Close(executor); err != nil {
+		t.Fatal(err)
+	}
+	s.mutex.Lock()
+	maxActive := s.maxActive
+	s.mutex.Unlock()
+	if purged := s.reset(false); len(purged) != 20 {
+		t.Errorf("purged %v trailing urls, want 20", len(purged))
+	}
+	if maxActive > 2 {
+		t.Errorf("%v purges sent at the same time, want at most 2", maxActive)
+	}
+}
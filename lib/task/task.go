@@ -1,7 +1,11 @@
 package task
 
 import (
+	"errors"
+	"fmt"
 	"sync"
+
+	"gopkg.in/yaml.v2"
 )
 
 // Executor can execute a certain from a kafka message
@@ -9,57 +13,117 @@ type Executor interface {
 	Execute(message []byte) error
 }
 
-// Type is an enum for task types
-type Type int16
+// Closer is implemented by executors which keep work after Execute returns, such as batched purges
+type Closer interface {
+	// Close finishes the pending work, it's called when the executor is no longer used
+	Close() error
+}
+
+// Close finishes the pending work of an executor if it's a Closer
+func Close(executor Executor) error {
+	if c, ok := executor.(Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// ExecuteError is returned when a task still fails after being attempted several times,
+// or fails permanently and is not worth retrying
+type ExecuteError struct {
+	Err       error
+	Attempts  int
+	Permanent bool
+}
+
+func (e *ExecuteError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ExecuteError) Unwrap() error {
+	return e.Err
+}
+
+// Attempts returns how many times a failed task has been attempted
+func Attempts(err error) int {
+	var e *ExecuteError
+	if errors.As(err, &e) {
+		return e.Attempts
+	}
+	return 1
+}
+
+// Permanent reports whether a task failed permanently
+func Permanent(err error) bool {
+	var e *ExecuteError
+	if errors.As(err, &e) {
+		return e.Permanent
+	}
+	return false
+}
 
+// Task types of the built-in executors
 const (
 	// JobRunnerTask executes a MediaWiki job via event bus
-	JobRunnerTask Type = iota
+	JobRunnerTask = "job-runner"
 	// PurgeTask purges the front-end cache of a URL
-	PurgeTask
+	PurgeTask = "purge"
 )
 
-var getexMutex sync.Mutex
-var taskMap = make(map[Type]Executor)
+// DefaultType is the task type of rules without taskType
+const DefaultType = JobRunnerTask
 
-func (t Type) String() string {
-	switch t {
-	case JobRunnerTask:
-		return "job-runner"
-	case PurgeTask:
-		return "purge"
-	}
-	return "unknown"
+// Definition describes how to create executors of a task type
+type Definition struct {
+	// NewConfig returns the default configuration of an executor, the task config of a rule is decoded into it
+	NewConfig func() interface{}
+	// New creates an executor from the configuration returned by NewConfig
+	New func(config interface{}) (Executor, error)
 }
 
-// GetExecutor returns a task executor for a task type
-func (t Type) GetExecutor() Executor {
-	getexMutex.Lock()
-	defer getexMutex.Unlock()
+var registryMutex sync.RWMutex
+var registry = make(map[string]Definition)
+
+// Register adds a task type, it panics if the task type is already registered
+func Register(taskType string, definition Definition) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
 
-	if executor, ok := taskMap[t]; ok {
-		return executor
+	if _, ok := registry[taskType]; ok {
+		panic("task type already registered: " + taskType)
 	}
+	registry[taskType] = definition
+}
 
-	var executor Executor
-	switch t {
-	case JobRunnerTask:
-		executor = DefaultJobRunnerExecutor()
-	case PurgeTask:
-		executor = DefaultPurgeExecutor()
+// NormalizeType returns DefaultType for an empty task type
+func NormalizeType(taskType string) string {
+	if taskType == "" {
+		return DefaultType
 	}
-	taskMap[t] = executor
-	return executor
+	return taskType
 }
 
-// TypeFromString returns a task type from a string
-func TypeFromString(s string) Type {
-	switch s {
-	case JobRunnerTask.String():
-		return JobRunnerTask
-	case PurgeTask.String():
-		return PurgeTask
-	default:
-		return JobRunnerTask
+// NewExecutor creates an executor of a task type, options override the default configuration of the executor in order
+func NewExecutor(taskType string, options ...map[string]interface{}) (Executor, error) {
+	taskType = NormalizeType(taskType)
+	registryMutex.RLock()
+	definition, ok := registry[taskType]
+	registryMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown task type: %v", taskType)
+	}
+
+	config := definition.NewConfig()
+	for _, o := range options {
+		if len(o) == 0 {
+			continue
+		}
+		data, err := yaml.Marshal(o)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.UnmarshalStrict(data, config); err != nil {
+			return nil, fmt.Errorf("invalid task config of %v: %v", taskType, err)
+		}
 	}
+	return definition.New(config)
 }
@@ -0,0 +1,95 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// messageTemplate is a string with placeholders like {{meta.uri}}, which are gjson paths of a message.
+// A path can be followed by filters, e.g. {{title|url}}:
+//
+//	json    the value encoded as json, e.g. "Pikachu" with quotes
+//	url     the value escaped for a query string
+//	path    the value escaped for a url path segment
+type messageTemplate struct {
+	parts []templatePart
+}
+
+type templatePart struct {
+	text    string
+	path    string
+	filters []string
+}
+
+func compileTemplate(s string) (*messageTemplate, error) {
+	t := &messageTemplate{}
+	for len(s) > 0 {
+		start := strings.Index(s, "{{")
+		if start < 0 {
+			t.parts = append(t.parts, templatePart{text: s})
+			break
+		}
+		if start > 0 {
+			t.parts = append(t.parts, templatePart{text: s[:start]})
+		}
+		end := strings.Index(s[start:], "}}")
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed placeholder in template: %v", s[start:])
+		}
+		fields := strings.Split(s[start+2:start+end], "|")
+		part := templatePart{path: strings.TrimSpace(fields[0])}
+		if part.path == "" {
+			return nil, fmt.Errorf("empty placeholder in template: %v", s[start:start+end+2])
+		}
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			switch f {
+			case "json", "url", "path":
+			default:
+				return nil, fmt.Errorf("unknown template filter: %v", f)
+			}
+			part.filters = append(part.filters, f)
+		}
+		t.parts = append(t.parts, part)
+		s = s[start+end+2:]
+	}
+	return t, nil
+}
+
+// render replaces placeholders with values in a message, a missing value is an empty string, or null in json
+func (t *messageTemplate) render(message []byte) string {
+	var sb strings.Builder
+	for _, p := range t.parts {
+		if p.path == "" {
+			sb.WriteString(p.text)
+			continue
+		}
+		r := gjson.GetBytes(message, p.path)
+		v := r.String()
+		raw := true
+		for _, f := range p.filters {
+			switch f {
+			case "json":
+				if !raw {
+					b, _ := json.Marshal(v)
+					v = string(b)
+				} else if r.Exists() {
+					v = r.Raw
+				} else {
+					v = "null"
+				}
+			case "url":
+				v = url.QueryEscape(v)
+			case "path":
+				v = url.PathEscape(v)
+			}
+			raw = false
+		}
+		sb.WriteString(v)
+	}
+	return sb.String()
+}
@@ -0,0 +1,115 @@
+package task
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	rate "github.com/beefsack/go-rate"
+	"github.com/mudkipme/timburr/metrics"
+	"github.com/mudkipme/timburr/utils"
+	"github.com/tidwall/gjson"
+)
+
+// TenantExecutor executes messages of each wiki in a wiki farm with the executor of its tenant
+type TenantExecutor struct {
+	taskType  string
+	tenants   []*tenant
+	domains   map[string]*tenant
+	databases map[string]*tenant
+}
+
+type tenant struct {
+	name     string
+	executor Executor
+	limiter  *rate.RateLimiter
+}
+
+// ErrUnknownTenant is returned for messages which don't belong to any tenant
+var ErrUnknownTenant = errors.New("unknown tenant")
+
+// NewTenantExecutor creates an executor of a task type for each tenant,
+// the configuration of a tenant overrides options, which override the default configuration
+func NewTenantExecutor(taskType string, tenants []utils.TenantConfig, options map[string]interface{}) (*TenantExecutor, error) {
+	t := &TenantExecutor{
+		taskType:  NormalizeType(taskType),
+		domains:   make(map[string]*tenant),
+		databases: make(map[string]*tenant),
+	}
+	for _, c := range tenants {
+		var tenantOptions map[string]interface{}
+		for k, v := range c.TaskConfig {
+			if NormalizeType(k) == t.taskType {
+				tenantOptions = v
+			}
+		}
+		executor, err := NewExecutor(taskType, options, tenantOptions)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %v: %v", c.Name, err)
+		}
+		tn := &tenant{name: c.Name, executor: executor}
+		if c.RateLimit > 0 {
+			interval := c.RateInterval
+			if interval == 0 {
+				interval = 1000
+			}
+			tn.limiter = rate.New(c.RateLimit, time.Duration(interval)*time.Millisecond)
+		}
+		for _, domain := range c.Domains {
+			if _, ok := t.domains[domain]; ok {
+				return nil, fmt.Errorf("duplicated tenant domain: %v", domain)
+			}
+			t.domains[domain] = tn
+		}
+		for _, database := range c.Databases {
+			if _, ok := t.databases[database]; ok {
+				return nil, fmt.Errorf("duplicated tenant database: %v", database)
+			}
+			t.databases[database] = tn
+		}
+		t.tenants = append(t.tenants, tn)
+	}
+	return t, nil
+}
+
+// Execute finds the tenant of a message by meta.domain or database, messages of unknown tenants are rejected
+func (t *TenantExecutor) Execute(message []byte) error {
+	tn := t.find(message)
+	if tn == nil {
+		metrics.UnknownTenants.WithLabelValues(t.taskType).Inc()
+		return &ExecuteError{
+			Err:       fmt.Errorf("%v: domain %q, database %q", ErrUnknownTenant, gjson.GetBytes(message, "meta.domain").String(), gjson.GetBytes(message, "database").String()),
+			Attempts:  1,
+			Permanent: true,
+		}
+	}
+	if tn.limiter != nil {
+		tn.limiter.Wait()
+	}
+	return tn.executor.Execute(message)
+}
+
+// Close finishes the pending work of executors of every tenant
+func (t *TenantExecutor) Close() error {
+	var err error
+	for _, tn := range t.tenants {
+		if e := Close(tn.executor); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (t *TenantExecutor) find(message []byte) *tenant {
+	if domain := gjson.GetBytes(message, "meta.domain").String(); domain != "" {
+		if tn, ok := t.domains[domain]; ok {
+			return tn
+		}
+	}
+	if database := gjson.GetBytes(message, "database").String(); database != "" {
+		if tn, ok := t.databases[database]; ok {
+			return tn
+		}
+	}
+	return nil
+}
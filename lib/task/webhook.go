@@ -0,0 +1,145 @@
+package task
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mudkipme/timburr/metrics"
+	"github.com/mudkipme/timburr/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// WebhookTask sends an http request made from templates for each message
+const WebhookTask = "webhook"
+
+// WebhookExecutor sends http requests made from templates of a message
+type WebhookExecutor struct {
+	method        string
+	url           *messageTemplate
+	headers       map[string]*messageTemplate
+	body          *messageTemplate
+	successCodes  map[int]bool
+	retryAttempts int
+	retryBackoff  time.Duration
+	client        *http.Client
+}
+
+func init() {
+	Register(WebhookTask, Definition{
+		NewConfig: func() interface{} {
+			config := utils.CurrentConfig().Webhook
+			return &config
+		},
+		New: func(config interface{}) (Executor, error) {
+			return NewWebhookExecutor(config.(*utils.WebhookConfig))
+		},
+	})
+}
+
+// NewWebhookExecutor creates a new webhook executor
+func NewWebhookExecutor(config *utils.WebhookConfig) (*WebhookExecutor, error) {
+	if config.URL == "" {
+		return nil, errors.New("webhook url is required")
+	}
+	t := &WebhookExecutor{
+		method:        strings.ToUpper(config.Method),
+		headers:       make(map[string]*messageTemplate),
+		retryAttempts: config.RetryAttempts,
+		retryBackoff:  time.Duration(config.RetryBackoff) * time.Millisecond,
+	}
+	if t.method == "" {
+		t.method = http.MethodPost
+	}
+	if t.retryAttempts <= 0 {
+		t.retryAttempts = 1
+	}
+	if t.retryBackoff <= 0 {
+		t.retryBackoff = time.Second
+	}
+	timeout := time.Duration(config.Timeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	t.client = &http.Client{Timeout: timeout}
+
+	var err error
+	if t.url, err = compileTemplate(config.URL); err != nil {
+		return nil, fmt.Errorf("invalid webhook url: %v", err)
+	}
+	if t.body, err = compileTemplate(config.Body); err != nil {
+		return nil, fmt.Errorf("invalid webhook body: %v", err)
+	}
+	for k, v := range config.Headers {
+		if t.headers[k], err = compileTemplate(v); err != nil {
+			return nil, fmt.Errorf("invalid webhook header %v: %v", k, err)
+		}
+	}
+	if len(config.SuccessCodes) > 0 {
+		t.successCodes = make(map[int]bool)
+		for _, code := range config.SuccessCodes {
+			t.successCodes[code] = true
+		}
+	}
+	return t, nil
+}
+
+// Execute sends the request of a message, and retries on network errors, 429 and 5xx responses
+func (t *WebhookExecutor) Execute(message []byte) error {
+	url := t.url.render(message)
+	body := t.body.render(message)
+	headers := make(map[string]string, len(t.headers))
+	for k, v := range t.headers {
+		headers[k] = v.render(message)
+	}
+
+	wait := t.retryBackoff
+	var err error
+	for attempt := 1; attempt <= t.retryAttempts; attempt++ {
+		var retryable bool
+		if retryable, err = t.doExecute(url, body, headers); err == nil {
+			log.WithField("url", url).Info("webhook executed")
+			return nil
+		}
+		if !retryable {
+			return &ExecuteError{Err: err, Attempts: attempt, Permanent: true}
+		}
+		if attempt < t.retryAttempts {
+			metrics.ExecuteRetries.WithLabelValues(WebhookTask).Inc()
+			time.Sleep(wait)
+			wait *= 2
+		}
+	}
+	return &ExecuteError{Err: err, Attempts: t.retryAttempts}
+}
+
+func (t *WebhookExecutor) doExecute(url string, body string, headers map[string]string) (bool, error) {
+	req, err := http.NewRequest(t.method, url, strings.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if t.success(resp.StatusCode) {
+		return false, nil
+	}
+	rb, _ := ioutil.ReadAll(resp.Body)
+	err = fmt.Errorf("webhook failed, status: %v, response: %v", resp.StatusCode, string(rb))
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+}
+
+func (t *WebhookExecutor) success(code int) bool {
+	if t.successCodes == nil {
+		return code >= 200 && code < 300
+	}
+	return t.successCodes[code]
+}
@@ -0,0 +1,61 @@
+package lib
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+)
+
+// workerPool handles messages concurrently, messages with the same key are always handled by the same worker in order
+type workerPool struct {
+	queues   []chan *kafka.Message
+	handler  func(*kafka.Message)
+	inFlight sync.WaitGroup
+	workers  sync.WaitGroup
+}
+
+func newWorkerPool(size int, handler func(*kafka.Message)) *workerPool {
+	if size < 1 {
+		size = 1
+	}
+	p := &workerPool{
+		queues:  make([]chan *kafka.Message, size),
+		handler: handler,
+	}
+	for i := range p.queues {
+		p.queues[i] = make(chan *kafka.Message, 1)
+		p.workers.Add(1)
+		go p.work(p.queues[i])
+	}
+	return p
+}
+
+func (p *workerPool) work(queue chan *kafka.Message) {
+	defer p.workers.Done()
+	for km := range queue {
+		p.handler(km)
+		p.inFlight.Done()
+	}
+}
+
+// dispatch sends a message to the worker of the key, it blocks when the worker is busy
+func (p *workerPool) dispatch(key string, km *kafka.Message) {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	p.inFlight.Add(1)
+	p.queues[h.Sum32()%uint32(len(p.queues))] <- km
+}
+
+// wait blocks until all dispatched messages are handled
+func (p *workerPool) wait() {
+	p.inFlight.Wait()
+}
+
+// stop waits for dispatched messages and stops all workers
+func (p *workerPool) stop() {
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	p.workers.Wait()
+}
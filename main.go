@@ -4,6 +4,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -12,35 +13,107 @@ import (
 	"github.com/mudkipme/timburr/utils"
 )
 
+// version is set at build time with -ldflags "-X main.version=<version>"
+var version = "dev"
+
 func main() {
 	log.SetFormatter(&log.JSONFormatter{})
 
 	if err := utils.InitConfig(); err != nil {
 		log.WithError(err).Panic("config init failed")
 	}
+	config := utils.CurrentConfig()
+
+	if hook := logstashHook(); hook != nil {
+		log.AddHook(hook)
+		// log.Fatal exits without deferred calls, so queued entries are sent by the exit handler
+		log.RegisterExitHandler(func() {
+			hook.Close(5 * time.Second)
+		})
+		defer hook.Close(5 * time.Second)
+	}
 
 	server, err := server.NewTimburrServer(&server.ServerConfig{
-		BrokerList:   utils.Config.Kafka.BrokerList,
-		Listen:       utils.Config.Options.Listen,
-		TopicKey:     utils.Config.Options.TopicKey,
-		DefaultTopic: utils.Config.Options.DefaultTopic,
+		BrokerList:   config.Kafka.BrokerList,
+		Listen:       config.Options.Listen,
+		TopicKey:     config.Options.TopicKey,
+		DefaultTopic: config.Options.DefaultTopic,
+		AdminToken:   config.Options.AdminToken,
 	})
 	if err != nil {
 		log.WithError(err).Panic("create server failed")
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		err := replay(server.Producer(), os.Args[2:])
+		server.Close()
+		if err != nil {
+			log.WithError(err).Fatal("replay failed")
+		}
+		return
+	}
+
+	sub := lib.DefaultSubscriber(server.Producer())
+	server.SetSubscriber(sub)
 	go server.Start()
 
-	sub := lib.DefaultSubscriber()
-	for _, rule := range utils.Config.Rules {
+	for _, rule := range config.Rules {
 		if err := sub.Subscribe(rule); err != nil {
 			log.WithError(err).Panicf("subscribe rule %v failed", rule.Name)
 		}
 	}
 
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
+	if interval := config.Options.ConfigWatchInterval; interval > 0 {
+		go utils.WatchConfig(time.Duration(interval)*time.Millisecond, func() {
+			reloadChan <- syscall.SIGHUP
+		})
+	}
+
 	sigchan := make(chan os.Signal, 1)
 	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigchan
-	sub.Unsubscribe()
-	server.Close()
+	for {
+		select {
+		case <-reloadChan:
+			reload(sub)
+		case <-sigchan:
+			sub.Unsubscribe()
+			server.Close()
+			return
+		}
+	}
+}
+
+// logstashHook creates a hook to send logs to logstash if options.logstash is set
+func logstashHook() *utils.LogstashHook {
+	options := utils.CurrentConfig().Options
+	if options.Logstash == "" {
+		return nil
+	}
+	instance := options.InstanceName
+	if instance == "" {
+		instance, _ = os.Hostname()
+	}
+	fields := log.Fields{
+		"instance": instance,
+		"version":  version,
+	}
+	for k, v := range options.LogstashFields {
+		fields[k] = v
+	}
+	return utils.NewLogstashHook(options.LogstashProtocol, options.Logstash, options.LogstashQueueSize, fields)
+}
+
+// reload applies the changes of config.yml to executors and rules
+func reload(sub *lib.Subscriber) {
+	if err := utils.ReloadConfig(); err != nil {
+		log.WithError(err).Error("reload config failed")
+		return
+	}
+	if err := sub.Reload(utils.CurrentConfig().Rules); err != nil {
+		log.WithError(err).Error("reload rules failed")
+		return
+	}
+	log.Info("config reloaded")
 }
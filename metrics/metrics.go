@@ -0,0 +1,134 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "timburr"
+
+var (
+	// EventsReceived counts events received by the http server
+	EventsReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_events_received_total",
+		Help:      "Number of events received by the http server.",
+	}, []string{"topic"})
+
+	// ProduceDuration observes the latency of producing messages to kafka
+	ProduceDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "produce_duration_seconds",
+		Help:      "Latency of producing messages to kafka.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"topic"})
+
+	// ProduceFailures counts messages failed to produce to kafka
+	ProduceFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "produce_failures_total",
+		Help:      "Number of messages failed to produce to kafka.",
+	}, []string{"topic"})
+
+	// MessagesConsumed counts messages consumed by rules
+	MessagesConsumed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_consumed_total",
+		Help:      "Number of messages consumed by each rule.",
+	}, []string{"rule", "topic"})
+
+	// MessagesFiltered counts messages skipped by the filter of rules
+	MessagesFiltered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_filtered_total",
+		Help:      "Number of messages skipped by the filter of each rule.",
+	}, []string{"rule"})
+
+	// ExecuteDuration observes the duration and outcome of executing tasks
+	ExecuteDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "execute_duration_seconds",
+		Help:      "Duration of executing tasks, including retries.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 15),
+	}, []string{"task", "outcome"})
+
+	// ExecuteRetries counts retries of executing tasks
+	ExecuteRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "execute_retries_total",
+		Help:      "Number of retries of executing tasks.",
+	}, []string{"task"})
+
+	// InvalidSignatures counts jobs whose mediawiki_signature doesn't verify
+	InvalidSignatures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "invalid_signatures_total",
+		Help:      "Number of jobs with an invalid mediawiki_signature.",
+	}, []string{"action"})
+
+	// UnknownTenants counts messages rejected for not belonging to any tenant
+	UnknownTenants = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "unknown_tenants_total",
+		Help:      "Number of messages rejected for not belonging to any tenant.",
+	}, []string{"task"})
+
+	// PurgesDeduplicated counts purges skipped for being sent recently
+	PurgesDeduplicated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "purges_deduplicated_total",
+		Help:      "Number of purges skipped for being sent within the dedupe window.",
+	}, []string{"method"})
+
+	// PurgeRequests counts purge requests by outcome
+	PurgeRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "purge_requests_total",
+		Help:      "Number of purge requests by method and outcome.",
+	}, []string{"method", "outcome"})
+
+	// DeadLetters counts messages produced to dead-letter topics
+	DeadLetters = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dead_letters_total",
+		Help:      "Number of failed messages sent to dead-letter topics.",
+	}, []string{"rule", "outcome"})
+
+	// RateLimitWait observes the time waiting for the rate limiter of rules
+	RateLimitWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "rate_limit_wait_seconds",
+		Help:      "Time waiting for the rate limiter of each rule.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 16),
+	}, []string{"rule"})
+
+	// ConsumerLag is the number of messages not consumed yet in each partition
+	ConsumerLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "consumer_lag",
+		Help:      "Number of messages behind the high watermark of each partition.",
+	}, []string{"rule", "topic", "partition"})
+
+	// MetadataRefreshes counts the results of refreshing topics by the metadata watcher
+	MetadataRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "metadata_refreshes_total",
+		Help:      "Number of topic refreshes by the metadata watcher.",
+	}, []string{"outcome"})
+)
+
+// Outcome returns the outcome label of an error
+func Outcome(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// Handler returns the http handler of the metrics endpoint
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
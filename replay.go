@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
+
+	"github.com/mudkipme/timburr/lib"
+	"github.com/mudkipme/timburr/utils"
+)
+
+// replay runs the replay subcommand, e.g. timburr replay -topic timburr-dead-letter -rule basic -since 2020-01-01T00:00:00Z
+func replay(producer *kafka.Producer, args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	topic := flags.String("topic", "", "topic to read messages from")
+	partition := flags.Int("partition", -1, "only replay this partition, -1 for all partitions")
+	fromOffset := flags.Int64("from-offset", -1, "first offset to replay, -1 for the earliest offset")
+	toOffset := flags.Int64("to-offset", -1, "last offset to replay, -1 for the latest offset")
+	since := flags.String("since", "", "only replay messages produced at or after this time, in RFC 3339 format")
+	until := flags.String("until", "", "only replay messages produced before this time, in RFC 3339 format")
+	rule := flags.String("rule", "", "only replay dead-lettered messages of this rule")
+	target := flags.String("target", "", "produce messages to this topic instead of their original topics")
+	dryRun := flags.Bool("dry-run", false, "log the messages to replay without producing them")
+	rateLimit := flags.Int("rate", 0, "replay at most this number of messages per second, 0 for unlimited")
+	flags.Parse(args)
+
+	config := &lib.ReplayConfig{
+		BrokerList:   utils.CurrentConfig().Kafka.BrokerList,
+		GroupID:      utils.CurrentConfig().Options.GroupIDPrefix + "replay",
+		Producer:     producer,
+		Topic:        *topic,
+		Partition:    int32(*partition),
+		FromOffset:   *fromOffset,
+		ToOffset:     *toOffset,
+		Rule:         *rule,
+		TargetTopic:  *target,
+		DryRun:       *dryRun,
+		RateLimit:    *rateLimit,
+		RateInterval: time.Second,
+	}
+	var err error
+	if *since != "" {
+		if config.Since, err = time.Parse(time.RFC3339, *since); err != nil {
+			return err
+		}
+	}
+	if *until != "" {
+		if config.Until, err = time.Parse(time.RFC3339, *until); err != nil {
+			return err
+		}
+	}
+
+	result, err := lib.Replay(config)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"replayed": result.Replayed,
+		"skipped":  result.Skipped,
+		"failed":   result.Failed,
+	}).Info("replay finished")
+	return nil
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mudkipme/timburr/lib"
+	log "github.com/sirupsen/logrus"
+)
+
+// serveAdmin handles the admin API:
+//
+//	GET  /admin/rules               lists rules with their partitions, lag and last error
+//	POST /admin/rules/<name>/pause  pauses a rule
+//	POST /admin/rules/<name>/resume resumes a rule
+//	POST /admin/rules/<name>/reset?to=<earliest|latest|RFC 3339 time|offset>[&topic=<topic>][&partition=<partition>]
+func (s *TimburrServer) serveAdmin(w http.ResponseWriter, req *http.Request) {
+	if !s.authorized(req) {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+	if s.subscriber == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "no subscriber"})
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/admin"), "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "rules" && req.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, s.subscriber.Status())
+	case len(parts) == 3 && parts[0] == "rules" && req.Method == http.MethodPost:
+		s.serveRuleAction(w, req, parts[1], parts[2])
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+	}
+}
+
+func (s *TimburrServer) serveRuleAction(w http.ResponseWriter, req *http.Request, name, action string) {
+	var err error
+	switch action {
+	case "pause":
+		err = s.subscriber.Pause(name)
+	case "resume":
+		err = s.subscriber.Resume(name)
+	case "reset":
+		var reset lib.OffsetReset
+		reset, err = parseOffsetReset(req)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		err = s.subscriber.ResetOffsets(name, reset)
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+
+	logger := log.WithField("rule", name).WithField("action", action)
+	if err == lib.ErrRuleNotFound {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Warn("admin action failed")
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	logger.Info("admin action done")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *TimburrServer) authorized(req *http.Request) bool {
+	if s.config.AdminToken == "" {
+		return false
+	}
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.config.AdminToken)) == 1
+}
+
+func parseOffsetReset(req *http.Request) (lib.OffsetReset, error) {
+	query := req.URL.Query()
+	reset := lib.OffsetReset{
+		To:        query.Get("to"),
+		Topic:     query.Get("topic"),
+		Partition: -1,
+	}
+	if p := query.Get("partition"); p != "" {
+		partition, err := strconv.ParseInt(p, 10, 32)
+		if err != nil {
+			return reset, err
+		}
+		reset.Partition = int32(partition)
+	}
+
+	switch reset.To {
+	case "earliest", "latest":
+		return reset, nil
+	}
+	if offset, err := strconv.ParseInt(reset.To, 10, 64); err == nil {
+		reset.To = "offset"
+		reset.Offset = offset
+		return reset, nil
+	}
+	t, err := time.Parse(time.RFC3339, reset.To)
+	if err != nil {
+		return reset, err
+	}
+	reset.To = "time"
+	reset.Time = t
+	return reset, nil
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(v)
+}
@@ -3,7 +3,11 @@ package server
 import (
 	"io/ioutil"
 	"net/http"
+	"strings"
+	"time"
 
+	"github.com/mudkipme/timburr/lib"
+	"github.com/mudkipme/timburr/metrics"
 	log "github.com/sirupsen/logrus"
 	"github.com/tidwall/gjson"
 	"gopkg.in/confluentinc/confluent-kafka-go.v1/kafka"
@@ -14,12 +18,14 @@ type ServerConfig struct {
 	Listen       string
 	TopicKey     string
 	DefaultTopic string
+	AdminToken   string
 }
 
 type TimburrServer struct {
-	producer *kafka.Producer
-	server   *http.Server
-	config   *ServerConfig
+	producer   *kafka.Producer
+	server     *http.Server
+	config     *ServerConfig
+	subscriber *lib.Subscriber
 }
 
 func NewTimburrServer(config *ServerConfig) (*TimburrServer, error) {
@@ -50,6 +56,8 @@ func (s *TimburrServer) sendMessage(data gjson.Result) error {
 	if topic == "" {
 		topic = s.config.DefaultTopic
 	}
+	metrics.EventsReceived.WithLabelValues(topic).Inc()
+	start := time.Now()
 
 	deliveryChan := make(chan kafka.Event, 1)
 	err := s.producer.Produce(&kafka.Message{
@@ -58,21 +66,39 @@ func (s *TimburrServer) sendMessage(data gjson.Result) error {
 	}, deliveryChan)
 	if err != nil {
 		log.WithError(err).Warn("http produce error")
+		metrics.ProduceFailures.WithLabelValues(topic).Inc()
 		return err
 	}
 
 	e := <-deliveryChan
 	m := e.(*kafka.Message)
+	metrics.ProduceDuration.WithLabelValues(topic).Observe(time.Since(start).Seconds())
 	if m.TopicPartition.Error != nil {
-		log.WithError(err).Warn("http produce error")
+		log.WithError(m.TopicPartition.Error).Warn("http produce error")
+		metrics.ProduceFailures.WithLabelValues(topic).Inc()
 		close(deliveryChan)
-		return err
+		return m.TopicPartition.Error
 	}
 	close(deliveryChan)
 	return nil
 }
 
 func (s *TimburrServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/admin" || strings.HasPrefix(req.URL.Path, "/admin/") {
+		s.serveAdmin(w, req)
+		return
+	}
+	if req.Method == http.MethodGet {
+		switch req.URL.Path {
+		case "/metrics":
+			metrics.Handler().ServeHTTP(w, req)
+		case "/healthz":
+			s.serveCheck(w, s.alive())
+		case "/readyz":
+			s.serveCheck(w, s.ready())
+		}
+		return
+	}
 	if req.Method != http.MethodPost {
 		return
 	}
@@ -107,6 +133,43 @@ func (s *TimburrServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// SetSubscriber sets the subscriber whose state is reported by health checks
+func (s *TimburrServer) SetSubscriber(subscriber *lib.Subscriber) {
+	s.subscriber = subscriber
+}
+
+func (s *TimburrServer) alive() error {
+	if s.subscriber == nil {
+		return nil
+	}
+	return s.subscriber.Alive()
+}
+
+func (s *TimburrServer) ready() error {
+	if _, err := s.producer.GetMetadata(nil, false, 5000); err != nil {
+		return err
+	}
+	if s.subscriber == nil {
+		return nil
+	}
+	return s.subscriber.Ready()
+}
+
+func (s *TimburrServer) serveCheck(w http.ResponseWriter, err error) {
+	if err != nil {
+		log.WithError(err).Warn("health check failed")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+// Producer returns the kafka producer of the server
+func (s *TimburrServer) Producer() *kafka.Producer {
+	return s.producer
+}
+
 func (s *TimburrServer) Start() error {
 	log.Infof("server start at %s", s.config.Listen)
 	return s.server.ListenAndServe()
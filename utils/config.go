@@ -1,19 +1,42 @@
 package utils
 
 import (
+	"os"
+	"sync/atomic"
+	"time"
+
 	"github.com/jinzhu/configor"
 )
 
+const configFile = "conf/config.yml"
+
 // RuleConfig is the configuration of a rule
 type RuleConfig struct {
-	Name          string   `yaml:"name"`
-	Topic         string   `yaml:"topic"`
-	Topics        []string `yaml:"topics"`
-	ExcludeTopics []string `yaml:"excludeTopics"`
-	Filter        string   `yaml:"filter"`
-	TaskType      string   `yaml:"taskType"`
-	RateLimit     int      `yaml:"rateLimit"`
-	RateInterval  int64    `yaml:"rateInterval"`
+	Name            string                 `yaml:"name"`
+	Topic           string                 `yaml:"topic"`
+	Topics          []string               `yaml:"topics"`
+	ExcludeTopics   []string               `yaml:"excludeTopics"`
+	Filter          string                 `yaml:"filter"`
+	TaskType        string                 `yaml:"taskType"`
+	TaskConfig      map[string]interface{} `yaml:"taskConfig"`
+	RateLimit       int                    `yaml:"rateLimit"`
+	RateInterval    int64                  `yaml:"rateInterval"`
+	DeadLetterTopic string                 `yaml:"deadLetterTopic"`
+	Concurrency     int                    `yaml:"concurrency"`
+	ConcurrencyKey  string                 `yaml:"concurrencyKey"`
+	// IgnoreTenants executes messages of the rule without tenants
+	IgnoreTenants bool `yaml:"ignoreTenants"`
+}
+
+// TenantConfig is a wiki in a wiki farm, events are matched by meta.domain or database
+type TenantConfig struct {
+	Name         string   `yaml:"name"`
+	Domains      []string `yaml:"domains"`
+	Databases    []string `yaml:"databases"`
+	RateLimit    int      `yaml:"rateLimit"`
+	RateInterval int64    `yaml:"rateInterval"`
+	// TaskConfig overrides the configuration of executors of each task type for this tenant
+	TaskConfig map[string]map[string]interface{} `yaml:"taskConfig"`
 }
 
 // PurgeEntryConfig defines how to generate purge requests for different hosts
@@ -23,39 +46,199 @@ type PurgeEntryConfig struct {
 	URIs     []string          `yaml:"uris"`
 	Headers  map[string]string `yaml:"headers"`
 	Variants []string          `toml:"variants"`
+	// HTCPAddresses are multicast groups or unicast addresses like "239.128.0.112:4827" of the htcp method
+	HTCPAddresses []string `yaml:"htcpAddresses"`
+	// HTCPTTL is the multicast ttl of htcp packets, default is 1
+	HTCPTTL int `yaml:"htcpTTL"`
+	// CFPurgeBy is either "files", "tags" or "prefixes" for the cloudflare method, default is "files"
+	CFPurgeBy string `yaml:"cfPurgeBy"`
+	// PathRegex limits the entry to urls whose path matches it
+	PathRegex string `yaml:"pathRegex"`
+	// ArticlePath is the path of pages to find titles and variants, default is "/wiki/"
+	ArticlePath string `yaml:"articlePath"`
+	// Rewrites are applied to purge urls in order
+	Rewrites []PurgeRewriteConfig `yaml:"rewrites"`
+	// ReboundDelay purges the url again after this delay in milliseconds, like $wgCdnReboundPurgeDelay
+	ReboundDelay int64 `yaml:"reboundDelay"`
+	// Concurrency is the maximum purge requests of the entry sent at the same time for a message, default is 10
+	Concurrency int `yaml:"concurrency"`
+	// Required fails the message if any purge of the entry fails or times out
+	Required bool `yaml:"required"`
+}
+
+// PurgeRewriteConfig replaces matches of a regular expression in purge urls, Replace can refer to groups like $1
+type PurgeRewriteConfig struct {
+	Match   string `yaml:"match"`
+	Replace string `yaml:"replace"`
+}
+
+// JobRunnerConfig is the configuration of job runner executors
+type JobRunnerConfig struct {
+	Endpoint string `yaml:"endpoint"`
+	// Endpoints are balanced by Balance, it overrides Endpoint if it's set
+	Endpoints []string `yaml:"endpoints"`
+	// Balance is either "round-robin" or "least-in-flight"
+	Balance string `yaml:"balance"`
+	// HealthCheckInterval is how often a down endpoint is checked in milliseconds
+	HealthCheckInterval int64 `yaml:"healthCheckInterval"`
+	// Routes send jobs of certain types to other endpoints
+	Routes        []JobRunnerRouteConfig `yaml:"routes"`
+	ExcludeFields []string               `yaml:"excludeFields"`
+	// SecretKey is $wgSecretKey of MediaWiki, jobs are verified and signed again by timburr if it's set
+	SecretKey string `yaml:"secretKey"`
+	// InvalidSignature is either "reject" or "flag"
+	InvalidSignature string `yaml:"invalidSignature"`
+	// RetryAttempts is the maximum number of attempts of retryable failures
+	RetryAttempts int `yaml:"retryAttempts"`
+	// RetryBackoff is the wait before the first retry in milliseconds, doubled after each retry
+	RetryBackoff int64 `yaml:"retryBackoff"`
+}
+
+// JobRunnerRouteConfig sends jobs whose type matches one of Types to Endpoints
+type JobRunnerRouteConfig struct {
+	// Types are job types which may contain wildcards, e.g. "cirrusSearch*"
+	Types     []string `yaml:"types"`
+	Endpoints []string `yaml:"endpoints"`
+	Balance   string   `yaml:"balance"`
+}
+
+// FastCGIConfig is the configuration of fastcgi executors, endpoints are addresses of PHP-FPM
+// like "127.0.0.1:9000" or "unix:///run/php/php-fpm.sock"
+type FastCGIConfig struct {
+	JobRunnerConfig `yaml:",inline"`
+	// ScriptFilename is the path of rest.php on the PHP-FPM server
+	ScriptFilename string `yaml:"scriptFilename"`
+	ScriptName     string `yaml:"scriptName"`
+	PathInfo       string `yaml:"pathInfo"`
+	// Params are extra FastCGI params, e.g. HTTP_HOST
+	Params map[string]string `yaml:"params"`
+	// PoolSize is the maximum number of idle connections of each endpoint, connections are not kept by default
+	PoolSize    int   `yaml:"poolSize"`
+	DialTimeout int64 `yaml:"dialTimeout"`
+	Timeout     int64 `yaml:"timeout"`
+}
+
+// WebhookConfig is the configuration of webhook executors, URL, Headers and Body are templates like {{meta.uri}}
+type WebhookConfig struct {
+	URL     string            `yaml:"url"`
+	Method  string            `yaml:"method"`
+	Headers map[string]string `yaml:"headers"`
+	Body    string            `yaml:"body"`
+	// SuccessCodes are the status codes of successful requests, default is 2xx
+	SuccessCodes  []int `yaml:"successCodes"`
+	Timeout       int64 `yaml:"timeout"`
+	RetryAttempts int   `yaml:"retryAttempts"`
+	RetryBackoff  int64 `yaml:"retryBackoff"`
+}
+
+// ProduceConfig is the configuration of produce executors, Topic and Key are templates like {{database}}
+type ProduceConfig struct {
+	Topic string `yaml:"topic"`
+	Key   string `yaml:"key"`
+	// Fields are the gjson paths kept in produced messages, all fields are kept if it's empty
+	Fields []string `yaml:"fields"`
+	// Rename moves the value of a path to another path
+	Rename map[string]string `yaml:"rename"`
 }
 
-// Config is the configuration of timburr
-var Config = struct {
+// PurgeConfig is the configuration of purge executors
+type PurgeConfig struct {
+	Expiry   int64              `yaml:"expiry"`
+	Entries  []PurgeEntryConfig `yaml:"entries"`
+	CFToken  string             `yaml:"cfToken"`
+	CFZoneID string             `yaml:"cfZoneID"`
+	// CFBatchWindow is how long cloudflare purges are gathered before being sent in batches, in milliseconds
+	CFBatchWindow int64 `yaml:"cfBatchWindow"`
+	// ReboundTopic is the kafka topic of rebound purges, which should be consumed by a purge rule
+	ReboundTopic string `yaml:"reboundTopic"`
+	// DedupeWindow skips urls purged within this time in milliseconds, across messages
+	DedupeWindow int64 `yaml:"dedupeWindow"`
+	// DedupeSize is the maximum number of urls remembered for DedupeWindow
+	DedupeSize int `yaml:"dedupeSize"`
+	// RetryAttempts is the maximum number of attempts of failed purges of required entries
+	RetryAttempts int `yaml:"retryAttempts"`
+	// RetryBackoff is the wait before the first retry in milliseconds, doubled after each retry
+	RetryBackoff int64 `yaml:"retryBackoff"`
+}
+
+// Configuration is the configuration of timburr
+type Configuration struct {
 	Kafka struct {
 		BrokerList string `yaml:"brokerList"`
 	} `yaml:"kafka"`
 
 	Options struct {
-		GroupIDPrefix                string `yaml:"groupIDPrefix"`
-		MetadataWatchGroupID         string `yaml:"metadataWatchGroupID"`
-		MetadataWatchRefreshInterval int64  `yaml:"metadataWatchRefreshInterval"`
-		Listen                       string `yaml:"listen"`
-		TopicKey                     string `yaml:"topicKey"`
-		DefaultTopic                 string `yaml:"defaultTopic"`
+		GroupIDPrefix                string            `yaml:"groupIDPrefix"`
+		MetadataWatchGroupID         string            `yaml:"metadataWatchGroupID"`
+		MetadataWatchRefreshInterval int64             `yaml:"metadataWatchRefreshInterval"`
+		Listen                       string            `yaml:"listen"`
+		TopicKey                     string            `yaml:"topicKey"`
+		DefaultTopic                 string            `yaml:"defaultTopic"`
+		LivenessTimeout              int64             `yaml:"livenessTimeout"`
+		ConfigWatchInterval          int64             `yaml:"configWatchInterval"`
+		AdminToken                   string            `yaml:"adminToken"`
+		Logstash                     string            `yaml:"logstash"`
+		LogstashProtocol             string            `yaml:"logstashProtocol"`
+		LogstashQueueSize            int               `yaml:"logstashQueueSize"`
+		LogstashFields               map[string]string `yaml:"logstashFields"`
+		InstanceName                 string            `yaml:"instanceName"`
 	} `yaml:"options"`
 
-	JobRunner struct {
-		Endpoint      string   `yaml:"endpoint"`
-		ExcludeFields []string `yaml:"excludeFields"`
-	} `yaml:"jobRunner"`
+	JobRunner JobRunnerConfig `yaml:"jobRunner"`
+
+	FastCGI FastCGIConfig `yaml:"fastcgi"`
+
+	Webhook WebhookConfig `yaml:"webhook"`
 
-	Purge struct {
-		Expiry   int64              `yaml:"expiry"`
-		Entries  []PurgeEntryConfig `yaml:"entries"`
-		CFToken  string             `yaml:"cfToken"`
-		CFZoneID string             `yaml:"cfZoneID"`
-	} `yaml:"purge"`
+	Purge PurgeConfig `yaml:"purge"`
+
+	Tenants []TenantConfig `yaml:"tenants"`
 
 	Rules []RuleConfig `yaml:"rules"`
-}{}
+}
+
+// currentConfig holds the *Configuration of timburr, which is replaced as a whole when it's reloaded
+var currentConfig atomic.Value
+
+// CurrentConfig returns the current configuration of timburr, it must not be modified
+func CurrentConfig() *Configuration {
+	if config, ok := currentConfig.Load().(*Configuration); ok {
+		return config
+	}
+	return &Configuration{}
+}
 
 // InitConfig initializes the configuration
 func InitConfig() error {
-	return configor.New(&configor.Config{ENVPrefix: "TIMBURR"}).Load(&Config, "conf/config.yml")
+	return ReloadConfig()
+}
+
+// ReloadConfig loads the configuration file again, the current configuration is kept if it fails
+func ReloadConfig() error {
+	config := &Configuration{}
+	if err := loadConfig(config); err != nil {
+		return err
+	}
+	currentConfig.Store(config)
+	return nil
+}
+
+// WatchConfig calls onChange whenever the configuration file is modified, it checks the file every interval
+func WatchConfig(interval time.Duration, onChange func()) {
+	var modTime time.Time
+	if info, err := os.Stat(configFile); err == nil {
+		modTime = info.ModTime()
+	}
+	for range time.Tick(interval) {
+		info, err := os.Stat(configFile)
+		if err != nil || info.ModTime().Equal(modTime) {
+			continue
+		}
+		modTime = info.ModTime()
+		onChange()
+	}
+}
+
+func loadConfig(config *Configuration) error {
+	return configor.New(&configor.Config{ENVPrefix: "TIMBURR"}).Load(config, configFile)
 }
@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// LogstashHook sends log entries as JSON lines to a Logstash tcp or udp input
+type LogstashHook struct {
+	network   string
+	address   string
+	fields    log.Fields
+	formatter log.Formatter
+	// mutex guards closed and sending to queue
+	mutex    sync.RWMutex
+	closed   bool
+	queue    chan []byte
+	dropped  uint64
+	conn     net.Conn
+	doneChan chan bool
+}
+
+// NewLogstashHook creates a logstash hook, entries are dropped when more than queueSize entries are waiting to be sent
+func NewLogstashHook(network, address string, queueSize int, fields log.Fields) *LogstashHook {
+	if network == "" {
+		network = "tcp"
+	}
+	if queueSize <= 0 {
+		queueSize = 1024
+	}
+	h := &LogstashHook{
+		network: network,
+		address: address,
+		fields:  fields,
+		formatter: &log.JSONFormatter{
+			FieldMap: log.FieldMap{
+				log.FieldKeyTime: "@timestamp",
+				log.FieldKeyMsg:  "message",
+			},
+		},
+		queue:    make(chan []byte, queueSize),
+		doneChan: make(chan bool),
+	}
+	go h.run()
+	return h
+}
+
+// Levels returns all log levels
+func (h *LogstashHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire queues a log entry, it never blocks the logger
+func (h *LogstashHook) Fire(entry *log.Entry) error {
+	data := make(log.Fields, len(entry.Data)+len(h.fields))
+	for k, v := range h.fields {
+		data[k] = v
+	}
+	for k, v := range entry.Data {
+		data[k] = v
+	}
+	line, err := h.formatter.Format(&log.Entry{
+		Logger:  entry.Logger,
+		Data:    data,
+		Time:    entry.Time,
+		Level:   entry.Level,
+		Caller:  entry.Caller,
+		Message: entry.Message,
+	})
+	if err != nil {
+		return err
+	}
+
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	if h.closed {
+		return nil
+	}
+	select {
+	case h.queue <- line:
+	default:
+		atomic.AddUint64(&h.dropped, 1)
+	}
+	return nil
+}
+
+func (h *LogstashHook) run() {
+	defer close(h.doneChan)
+	wait := 100 * time.Millisecond
+	for line := range h.queue {
+		// reconnect with backoff until the line is sent
+		for {
+			err := h.write(line)
+			if err == nil {
+				wait = 100 * time.Millisecond
+				break
+			}
+			if h.conn != nil {
+				h.conn.Close()
+				h.conn = nil
+			}
+			time.Sleep(wait)
+			if wait < 30*time.Second {
+				wait *= 2
+			}
+		}
+	}
+	if h.conn != nil {
+		h.conn.Close()
+	}
+}
+
+func (h *LogstashHook) write(line []byte) error {
+	if h.conn == nil {
+		conn, err := net.DialTimeout(h.network, h.address, 5*time.Second)
+		if err != nil {
+			return err
+		}
+		h.conn = conn
+		if dropped := atomic.SwapUint64(&h.dropped, 0); dropped > 0 {
+			log.WithField("dropped", dropped).Warn("logstash queue is full, log entries dropped")
+		}
+	}
+	h.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err := h.conn.Write(line)
+	return err
+}
+
+// Close stops accepting entries, and waits up to timeout for the queued entries to be sent
+func (h *LogstashHook) Close(timeout time.Duration) {
+	h.mutex.Lock()
+	if !h.closed {
+		h.closed = true
+		close(h.queue)
+	}
+	h.mutex.Unlock()
+	select {
+	case <-h.doneChan:
+	case <-time.After(timeout):
+	}
+}